@@ -0,0 +1,554 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// honeypotField is the name of a form field that themes should include as
+	// a text input hidden with CSS, like:
+	//
+	//	<input type="text" name="url_website" style="display:none" tabindex="-1" autocomplete="off">
+	//
+	// People never fill it in, but bots filling in every field do.
+	honeypotField = envString("HONEYPOT_FIELD", "url_website")
+
+	// rateLimit is the number of submissions allowed per IP in every
+	// rateWindow, zero disables rate limiting.
+	rateLimit  = envInt("RATE_LIMIT", 5)
+	rateWindow = envDuration("RATE_WINDOW", time.Minute)
+
+	// blockedWords are words and phrases that get a comment rejected, on top
+	// of those in the keyBlockedWords set.
+	blockedWords = splitList(os.Getenv("BLOCKED_WORDS"))
+
+	// duplicateWindow is how long the same comment can't be posted again,
+	// zero allows duplicates.
+	duplicateWindow = envDuration("DUPLICATE_WINDOW", time.Minute)
+
+	// maxLinks is the number of links a comment can have, zero allows any
+	// number. Comments with more links are rejected, or with
+	// MAX_LINKS_ACTION=hold, held for moderation without asking Akismet.
+	maxLinks       = envInt("MAX_LINKS", 0)
+	maxLinksAction = envString("MAX_LINKS_ACTION", "reject")
+
+	// formMinTime is how long it takes at least to fill in the comment form.
+	// When set, submissions need a form_token from /comments/token, that's
+	// at least this old and at most formTokenTTL.
+	formMinTime  = envDuration("FORM_MIN_TIME", 0)
+	formTokenTTL = envDuration("FORM_TOKEN_TTL", time.Hour)
+
+	// cooldown is how long an author has to wait between comments on the
+	// same page, zero lets them comment as often as rateLimit allows. With
+	// COOLDOWN_KEY=ip, authors are told apart by IP address, otherwise by
+	// their email, or IP address when they don't leave one.
+	cooldown    = envDuration("COOLDOWN", 0)
+	cooldownKey = envString("COOLDOWN_KEY", "email")
+
+	// checkReferer rejects comments unless their Referer is on the host of the
+	// page, or one of refererHosts. Browsers and privacy extensions can
+	// leave out the Referer, so it's opt-in.
+	checkReferer = os.Getenv("CHECK_REFERER") == "true"
+	refererHosts = splitList(strings.ToLower(os.Getenv("REFERER_HOSTS")))
+
+	// trustCommenters auto-approves comments by authors who had a comment
+	// approved before on the same host, going by their email. Anyone can
+	// enter someone else's email, so it trusts emails to stay private.
+	trustCommenters = os.Getenv("TRUST_COMMENTERS") == "true"
+
+	// moderateAll holds every comment for moderation, on all hosts or, with
+	// MODERATE_HOSTS, on those hosts. Akismet still checks them, to
+	// suggest what to do and to discard blatant spam.
+	moderateAll   = os.Getenv("MODERATE_ALL") == "true"
+	moderateHosts = splitList(strings.ToLower(os.Getenv("MODERATE_HOSTS")))
+
+	// reservedNames are author names nobody can comment under, like "admin"
+	// or the site owner's, unless the request has the admin token. With
+	// RESERVED_NAMES_ACTION=hold, comments under them are held for
+	// moderation instead of rejected.
+	reservedNames       = splitList(os.Getenv("RESERVED_NAMES"))
+	reservedNamesAction = envString("RESERVED_NAMES_ACTION", "reject")
+
+	// profanity are words and phrases that get masked with asterisks in
+	// comments, on top of those in the keyProfanity set. With
+	// PROFANITY_ACTION=reject, comments containing them are rejected instead.
+	profanity       = splitList(os.Getenv("PROFANITY"))
+	profanityAction = envString("PROFANITY_ACTION", "mask")
+)
+
+// errHoneypot means the submission filled in the honeypot field, and was
+// most likely made by a bot.
+var errHoneypot = errors.New("honeypot field filled in")
+
+// rateLimited counts a submission from ip, and reports whether ip went over
+// rateLimit. If so, it also returns how long until ip may submit again.
+func rateLimited(conn redis.Conn, ip string) (bool, time.Duration, error) {
+	return overLimit(conn, fmt.Sprintf(keyRateLimit, ip), rateLimit, rateWindow)
+}
+
+// overLimit counts a request in the counter at key, and reports whether it
+// went over limit requests per window. If so, it also returns how long until
+// the window ends. A limit of zero or less allows everything.
+func overLimit(conn redis.Conn, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	if limit <= 0 {
+		return false, 0, nil
+	}
+	n, err := redis.Int(conn.Do("INCR", key))
+	if err != nil {
+		return false, 0, err
+	}
+	if n == 1 {
+		_, err = conn.Do("PEXPIRE", key, int64(window/time.Millisecond))
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	if n <= limit {
+		return false, 0, nil
+	}
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		return true, 0, err
+	}
+	if ttl < 0 {
+		// The expiry got lost somehow, don't block forever
+		_, err = conn.Do("PEXPIRE", key, int64(window/time.Millisecond))
+		return true, window, err
+	}
+	return true, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// refererAllowed reports whether the Referer of req is on the page's host or
+// one of refererHosts, when checkReferer is on.
+func refererAllowed(req *commentSubmitRequest) bool {
+	if !checkReferer {
+		return true
+	}
+	u, err := url.Parse(req.Referrer)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := canonicalHost(strings.ToLower(u.Host))
+	if host == req.host {
+		return true
+	}
+	for _, h := range refererHosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// onCooldown reports whether the author of req commented on the same page
+// less than cooldown ago. If so, it also returns how long until they may
+// comment again.
+func onCooldown(conn redis.Conn, req *commentSubmitRequest) (bool, time.Duration, error) {
+	if cooldown <= 0 {
+		return false, 0, nil
+	}
+	ttl, err := redis.Int64(conn.Do("PTTL", cooldownKeyFor(req)))
+	if err != nil || ttl <= 0 {
+		// Not waiting, or done waiting just now
+		return false, 0, err
+	}
+	return true, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// startCooldown makes the author of req wait for cooldown before commenting
+// on the same page again, once their comment is saved.
+func startCooldown(conn redis.Conn, req *commentSubmitRequest) error {
+	if cooldown <= 0 {
+		return nil
+	}
+	_, err := conn.Do("SET", cooldownKeyFor(req), 1, "PX", int64(cooldown/time.Millisecond))
+	return err
+}
+
+// cooldownKeyFor returns the cooldown key of the author of req.
+func cooldownKeyFor(req *commentSubmitRequest) string {
+	author := "ip:" + req.realIP
+	if cooldownKey != "ip" && req.AuthorEmail != "" {
+		author = "email:" + strings.ToLower(req.AuthorEmail)
+	}
+	// Signed, so emails don't end up in key names
+	return fmt.Sprintf(keyCooldown, req.host, req.path, sign("cooldown", author))
+}
+
+// newFormToken returns a token holding the current time, signed to make sure
+// it came from here.
+func newFormToken(now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	n := hex.EncodeToString(nonce)
+	return ts + "." + n + "." + sign("form", ts, n), nil
+}
+
+var (
+	errFormToken = errors.New("bad form_token value")
+	errTooFast   = errors.New("form submitted too fast")
+)
+
+// checkFormToken makes sure token was handed out between formMinTime and
+// formTokenTTL ago, and wasn't used before.
+func checkFormToken(conn redis.Conn, token string, now time.Time) error {
+	if formMinTime <= 0 {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(sign("form", parts[0], parts[1]))) {
+		return errFormToken
+	}
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errFormToken
+	}
+	age := now.Sub(time.UnixMilli(ms))
+	if age > formTokenTTL {
+		return errFormToken
+	}
+	if age < formMinTime {
+		return errTooFast
+	}
+	// Remember the token until it expires anyway
+	_, err = redis.String(conn.Do("SET", fmt.Sprintf(keyFormToken, parts[1]), 1,
+		"NX", "PX", int64((formTokenTTL-age)/time.Millisecond)+1))
+	if err == redis.ErrNil {
+		return errFormToken
+	}
+	return err
+}
+
+func (s *Server) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	cors, err := corsOrigin(conn, r)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	token, err := newFormToken(s.now())
+	if err != nil {
+		slog.Error("Creating form token failed", "err", err)
+		http.Error(w, "unable to create token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	setCORS(w, cors)
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Token string `json:"token"`
+	}{token})
+}
+
+// isDuplicate reports whether the same author posted the same comment on the
+// same page within duplicateWindow, and starts the window if not.
+func isDuplicate(conn redis.Conn, req *commentSubmitRequest) (bool, error) {
+	if duplicateWindow <= 0 {
+		return false, nil
+	}
+	_, err := redis.String(conn.Do("SET", duplicateKey(req), 1, "NX", "PX", int64(duplicateWindow/time.Millisecond)))
+	if err == redis.ErrNil {
+		return true, nil
+	}
+	return false, err
+}
+
+// forgetDuplicate ends the window isDuplicate started, for when the comment
+// didn't get saved after all, so posting it again isn't a duplicate.
+func forgetDuplicate(conn redis.Conn, req *commentSubmitRequest) {
+	if duplicateWindow <= 0 {
+		return
+	}
+	if _, err := conn.Do("DEL", duplicateKey(req)); err != nil {
+		redisErrors.Inc()
+		slog.Error("Forgetting duplicate comment failed", "host", req.host, "path", req.path, "err", err)
+	}
+}
+
+// duplicateKey returns the key marking the comment of req as posted.
+func duplicateKey(req *commentSubmitRequest) string {
+	h := sha256.New()
+	for _, part := range []string{req.host, req.path, req.Author, req.Content} {
+		// Zero bytes between the parts, so they can't run into each other
+		io.WriteString(h, part)
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf(keyDuplicate, hex.EncodeToString(h.Sum(nil)))
+}
+
+// hasBlockedWord reports whether any of texts contains one of blockedWords or
+// the words in the keyBlockedWords set.
+func hasBlockedWord(conn redis.Conn, texts ...string) (bool, error) {
+	words, err := redis.Strings(conn.Do("SMEMBERS", keyBlockedWords))
+	if err != nil {
+		return false, err
+	}
+	words = append(words, blockedWords...)
+	for _, text := range texts {
+		text = strings.ToLower(text)
+		for _, word := range words {
+			if len(findWord(text, strings.ToLower(word))) > 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// findWord returns the byte offsets of every whole-word occurrence of word in
+// text, so "ass" doesn't match "class".
+func findWord(text, word string) []int {
+	var found []int
+	if word == "" {
+		return found
+	}
+	for start := 0; start < len(text); {
+		i := strings.Index(text[start:], word)
+		if i < 0 {
+			break
+		}
+		i += start
+		end := i + len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			found = append(found, i)
+		}
+		start = i + 1
+	}
+	return found
+}
+
+// errReservedName means the author name is in reservedNames.
+var errReservedName = errors.New("comment_author is a reserved name, choose another one")
+
+// heldReservedName is the held_reason of comments under a reserved name, with
+// RESERVED_NAMES_ACTION=hold.
+const heldReservedName = "reserved_name"
+
+// isReservedName reports whether name is one of reservedNames, ignoring case
+// and extra whitespace.
+func isReservedName(name string) bool {
+	name = strings.Join(strings.Fields(name), " ")
+	for _, reserved := range reservedNames {
+		if strings.EqualFold(name, strings.Join(strings.Fields(reserved), " ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// heldModeration is the held_reason of comments that would have been
+// approved, but are held because every comment on their host is moderated.
+const heldModeration = "moderation"
+
+// moderated reports whether every comment on host is held for moderation.
+func moderated(host string) bool {
+	if moderateAll {
+		return true
+	}
+	for _, h := range moderateHosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// errProfanity means a comment contains profanity, with PROFANITY_ACTION=reject.
+var errProfanity = errors.New("comment rejected")
+
+// cleanProfanity masks the profanity in content, or returns errProfanity when
+// it should be rejected instead.
+func cleanProfanity(conn redis.Conn, content string) (string, error) {
+	words, err := redis.Strings(conn.Do("SMEMBERS", keyProfanity))
+	if err != nil {
+		return "", err
+	}
+	words = append(words, profanity...)
+	masked, found := maskWords(content, words)
+	if found && profanityAction == "reject" {
+		return "", errProfanity
+	}
+	return masked, nil
+}
+
+// maskWords replaces the letters and digits of every whole-word occurrence of
+// words in text with asterisks, and reports whether there were any. It works
+// on runes rather than bytes, because lowercasing can change the length of a
+// rune.
+func maskWords(text string, words []string) (string, bool) {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		// Not to mask the wrong runes
+		lower = make([]rune, len(runes))
+		for i, r := range runes {
+			lower[i] = unicode.ToLower(r)
+		}
+	}
+	found := false
+	for _, word := range words {
+		w := []rune(strings.ToLower(word))
+		if len(w) == 0 {
+			continue
+		}
+		for i := 0; i+len(w) <= len(lower); i++ {
+			end := i + len(w)
+			if string(lower[i:end]) != string(w) ||
+				i > 0 && isWordRune(lower[i-1]) ||
+				end < len(lower) && isWordRune(lower[end]) {
+				continue
+			}
+			for j := i; j < end; j++ {
+				if isWordRune(runes[j]) {
+					runes[j] = '*'
+				}
+			}
+			found = true
+			i = end - 1
+		}
+	}
+	if !found {
+		return text, false
+	}
+	return string(runes), true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// ipBlocked reports whether ip, as clientIP returns it, is in the
+// keyBlockedIPs set, either as an address or as part of a CIDR range.
+func ipBlocked(conn redis.Conn, ip string) (bool, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, nil
+	}
+	blocked, err := redis.Strings(conn.Do("SMEMBERS", keyBlockedIPs))
+	if err != nil {
+		return false, err
+	}
+	for _, b := range blocked {
+		if _, ipnet, err := net.ParseCIDR(b); err == nil {
+			if ipnet.Contains(addr) {
+				return true, nil
+			}
+		} else if addr.Equal(net.ParseIP(b)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cleanBlockedIP normalizes an IP address or CIDR range for the
+// keyBlockedIPs set.
+func cleanBlockedIP(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet.String(), nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String(), nil
+	}
+	return "", errors.New("bad ip value")
+}
+
+const recaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+
+var (
+	// recaptchaSecret enables reCAPTCHA verification, when set
+	recaptchaSecret = os.Getenv("RECAPTCHA_SECRET")
+	recaptchaClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+var errRecaptcha = errors.New("bad g-recaptcha-response value")
+
+// verifyRecaptcha checks a reCAPTCHA response token with Google. It returns
+// errRecaptcha when the token doesn't check out.
+func verifyRecaptcha(token, ip string) error {
+	if recaptchaSecret == "" {
+		return nil
+	}
+	if token == "" {
+		return errRecaptcha
+	}
+	resp, err := recaptchaClient.PostForm(recaptchaVerifyURL, url.Values{
+		"secret":   {recaptchaSecret},
+		"response": {token},
+		"remoteip": {ip},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return errRecaptcha
+	}
+	return nil
+}
+
+// commentEmail returns the lowercased email of a comment's author, which is
+// empty when they didn't leave one.
+func commentEmail(conn redis.Conn, host, path string, id int64) (string, error) {
+	email, err := redis.String(conn.Do("HGET",
+		fmt.Sprintf(keyComment, host, path, id), "comment_author_email"))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return strings.ToLower(email), err
+}
+
+// isTrusted reports whether the author of a comment is a trusted commenter.
+func isTrusted(conn redis.Conn, host, path string, id int64) (bool, error) {
+	email, err := commentEmail(conn, host, path, id)
+	if err != nil || email == "" {
+		return false, err
+	}
+	return redis.Bool(conn.Do("SISMEMBER", fmt.Sprintf(keyTrusted, host), email))
+}
+
+// trustCommenter makes the author of a comment a trusted commenter.
+func trustCommenter(conn redis.Conn, host, path string, id int64) error {
+	email, err := commentEmail(conn, host, path, id)
+	if err != nil || email == "" {
+		return err
+	}
+	_, err = conn.Do("SADD", fmt.Sprintf(keyTrusted, host), email)
+	return err
+}
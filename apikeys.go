@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// hashAPIKey is what's stored of an API key, so a copy of Redis doesn't give
+// away the keys.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorizedFor checks the request's bearer token against ADMIN_TOKEN, like
+// authorized, or against the API key of host, which only gives access to the
+// comments on host.
+func authorizedFor(conn redis.Conn, r *http.Request, host string) (bool, error) {
+	if authorized(r) {
+		return true, nil
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return false, nil
+	}
+	hash, err := redis.String(conn.Do("HGET", keyAPIKeys, host))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(hash)) == 1, nil
+}
+
+// apiKeyHandler hands out a new API key for a host, replacing the one it had.
+// The key is only shown this once.
+func (s *Server) apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	host, err := cleanHostname(r.FormValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		slog.Error("Generating API key failed", "err", err)
+		http.Error(w, "unable to generate key", http.StatusInternalServerError)
+		return
+	}
+	key := hex.EncodeToString(b)
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err = conn.Do("HSET", keyAPIKeys, host, hashAPIKey(key)); err != nil {
+		backendError(w, err)
+		return
+	}
+	slog.Info("Created API key", "host", host)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Host   string `json:"host"`
+		APIKey string `json:"api_key"`
+	}{host, key})
+}
+
+// apiKeyRemoveHandler revokes the API key of a host.
+func (s *Server) apiKeyRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	host, err := cleanHostname(r.FormValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	removed, err := redis.Bool(conn.Do("HDEL", keyAPIKeys, host))
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if removed {
+		slog.Info("Removed API key", "host", host)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Host    string `json:"host"`
+		Changed bool   `json:"changed"`
+	}{host, removed})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// maxBulkOps is the number of operations bulkHandler takes at once
+const maxBulkOps = 100
+
+// bulkOp is a moderation action on a single comment
+type bulkOp struct {
+	URL string `json:"url"`
+	ID  int64  `json:"id"`
+	// Action is approve, unapprove or delete
+	Action string `json:"action"`
+}
+
+// bulkResult is the outcome of a bulkOp
+type bulkResult struct {
+	URL     string `json:"url"`
+	ID      int64  `json:"id"`
+	Action  string `json:"action"`
+	Changed bool   `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bulkHandler applies a JSON list of moderation actions, and returns the
+// result of each. One failing doesn't stop the others.
+func (s *Server) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBodySize))
+	var ops []bulkOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, "malformed JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ops) > maxBulkOps {
+		http.Error(w, fmt.Sprintf("too many operations, at most %d", maxBulkOps), http.StatusBadRequest)
+		return
+	}
+	reqs := make([]*moderationRequest, len(ops))
+	for i, op := range ops {
+		u, err := url.Parse(op.URL)
+		if err != nil || u.Host == "" {
+			http.Error(w, "bad URL: "+op.URL, http.StatusBadRequest)
+			return
+		}
+		switch op.Action {
+		case "approve", "unapprove", "delete":
+		default:
+			http.Error(w, "bad action: "+op.Action, http.StatusBadRequest)
+			return
+		}
+		u = normalizeURL(u)
+		reqs[i] = &moderationRequest{host: u.Host, path: u.Path, id: op.ID}
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	// Every host, so an API key can't slip in a comment of another host
+	if len(reqs) == 0 && !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	hosts := make(map[string]bool)
+	for _, req := range reqs {
+		if hosts[req.host] {
+			continue
+		}
+		ok, err := authorizedFor(conn, r, req.host)
+		if err != nil {
+			backendError(w, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hosts[req.host] = true
+	}
+	results, err := s.applyBulk(conn, ops, reqs)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(results)
+}
+
+// applyBulk applies ops to the comments of reqs. It looks up all the
+// comments in a single round-trip first, so only actions that change
+// something touch Redis again.
+func (s *Server) applyBulk(conn redis.Conn, ops []bulkOp, reqs []*moderationRequest) ([]bulkResult, error) {
+	for _, req := range reqs {
+		conn.Send("ZSCORE", fmt.Sprintf(keyAll, req.host, req.path), req.id)
+		conn.Send("ZSCORE", fmt.Sprintf(keyApproved, req.host, req.path), req.id)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	// By comment, so an earlier operation on the same comment counts
+	type state struct{ exists, approved bool }
+	states := make(map[moderationRequest]*state, len(reqs))
+	for _, req := range reqs {
+		var st state
+		for _, found := range []*bool{&st.exists, &st.approved} {
+			reply, err := conn.Receive()
+			if err != nil {
+				return nil, err
+			}
+			*found = reply != nil
+		}
+		states[*req] = &st
+	}
+	var ham, spam []*moderationRequest
+	results := make([]bulkResult, len(ops))
+	for i, op := range ops {
+		req := reqs[i]
+		st := states[*req]
+		results[i] = bulkResult{URL: op.URL, ID: op.ID, Action: op.Action}
+		if !st.exists {
+			results[i].Error = errNoComment.Error()
+			continue
+		}
+		var err error
+		switch {
+		case op.Action == "approve" && !st.approved:
+			results[i].Changed, err = approveComment(conn, req.host, req.path, req.id)
+			st.approved = err == nil
+			if results[i].Changed {
+				commentsApproved.WithLabelValues("admin").Inc()
+				ham = append(ham, req)
+			}
+		case op.Action == "unapprove" && st.approved:
+			results[i].Changed, err = unapproveComment(conn, req.host, req.path, req.id)
+			st.approved = false
+			if results[i].Changed {
+				commentsRejected.Inc()
+				spam = append(spam, req)
+			}
+		case op.Action == "delete":
+			err = trashComment(conn, req.host, req.path, req.id, s.now())
+			results[i].Changed = err == nil
+			st.exists = false
+		}
+		if err == errNoComment {
+			// Gone since the lookup
+			results[i].Error = err.Error()
+			continue
+		}
+		if err != nil {
+			redisErrors.Inc()
+			slog.Error("Bulk moderating comment failed", "host", req.host, "path", req.path, "id", req.id, "action", op.Action, "err", err)
+			results[i].Error = "unable to " + op.Action
+			continue
+		}
+		if results[i].Changed {
+			slog.Info("Bulk moderated comment", "host", req.host, "path", req.path, "id", req.id, "action", op.Action)
+		}
+	}
+	if len(ham)+len(spam) > 0 {
+		// Like the single comment endpoints, but not making the client wait
+		s.background.Add(1)
+		go s.submitBulk(ham, spam)
+	}
+	return results, nil
+}
+
+// submitBulk tells Akismet about the comments approved and unapproved by
+// bulkHandler.
+func (s *Server) submitBulk(ham, spam []*moderationRequest) {
+	defer s.background.Done()
+	conn := s.pool.Get()
+	defer conn.Close()
+	for _, req := range ham {
+		if err := s.submitHam(conn, req.host, req.path, req.id); err != nil {
+			slog.Warn("Submitting ham to Akismet failed", "host", req.host, "path", req.path, "id", req.id, "err", err)
+		}
+	}
+	for _, req := range spam {
+		if err := s.submitSpam(conn, req.host, req.path, req.id); err != nil {
+			slog.Warn("Submitting spam to Akismet failed", "host", req.host, "path", req.path, "id", req.id, "err", err)
+		}
+	}
+}
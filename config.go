@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envString reads the environment variable name, falling back to def when
+// it's not set.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer from the environment variable name, falling back to
+// def when it's not set. A malformed value is fatal, so typos show up at
+// startup.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		fatal("bad "+name+" value", "value", v, "err", err)
+	}
+	return i
+}
+
+// envDuration reads a duration like "90s" from the environment variable name,
+// falling back to def when it's not set. A malformed value is fatal.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fatal("bad "+name+" value", "value", v, "err", err)
+	}
+	return d
+}
+
+// envHostMap reads a comma separated list of host=value pairs from the
+// environment variable name, with the hosts lowercased. A malformed pair is
+// fatal.
+func envHostMap(name string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range splitList(os.Getenv(name)) {
+		host, value, ok := strings.Cut(pair, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		value = strings.TrimSpace(value)
+		if !ok || host == "" || value == "" {
+			fatal("bad "+name+" value", "value", pair)
+		}
+		m[host] = value
+	}
+	return m
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// disqusExport is a Disqus XML export. Posts refer to their thread, which
+// has the URL of the page, and to their parent post for replies.
+type disqusExport struct {
+	Threads []disqusThread `xml:"thread"`
+	Posts   []disqusPost   `xml:"post"`
+}
+
+type disqusThread struct {
+	ID   string `xml:"id,attr"`
+	Link string `xml:"link"`
+}
+
+type disqusPost struct {
+	ID        string `xml:"id,attr"`
+	Message   string `xml:"message"`
+	CreatedAt string `xml:"createdAt"`
+	IsDeleted bool   `xml:"isDeleted"`
+	IsSpam    bool   `xml:"isSpam"`
+	Author    struct {
+		Name  string `xml:"name"`
+		Email string `xml:"email"`
+	} `xml:"author"`
+	IPAddress string `xml:"ipAddress"`
+	Thread    struct {
+		ID string `xml:"id,attr"`
+	} `xml:"thread"`
+	Parent struct {
+		ID string `xml:"id,attr"`
+	} `xml:"parent"`
+}
+
+// importDisqus saves the comments in a Disqus export read from r, approved,
+// on the page of their thread's link. Deleted comments and spam are skipped.
+// It returns the number of comments imported per page, and with dryRun, it
+// only counts them without saving anything.
+func importDisqus(conn redis.Conn, r io.Reader, dryRun bool) (map[string]int, error) {
+	var export disqusExport
+	if err := xml.NewDecoder(r).Decode(&export); err != nil {
+		return nil, err
+	}
+	pages := make(map[string]*url.URL, len(export.Threads))
+	for _, t := range export.Threads {
+		u, err := url.Parse(t.Link)
+		if err != nil || u.Host == "" {
+			// Disqus has threads without a proper link, skip their posts
+			continue
+		}
+		pages[t.ID] = normalizeURL(u)
+	}
+	posts := make([]disqusPost, 0, len(export.Posts))
+	dates := make(map[string]time.Time, len(export.Posts))
+	for _, p := range export.Posts {
+		if p.IsDeleted || p.IsSpam || pages[p.Thread.ID] == nil {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, p.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("bad createdAt of post %s: %v", p.ID, err)
+		}
+		dates[p.ID] = date
+		posts = append(posts, p)
+	}
+	// Oldest first, so replies can point at the new id of their parent
+	sort.SliceStable(posts, func(i, j int) bool {
+		return dates[posts[i].ID].Before(dates[posts[j].ID])
+	})
+	counts := make(map[string]int)
+	ids := make(map[string]int64, len(posts))
+	for _, p := range posts {
+		u := pages[p.Thread.ID]
+		counts[u.String()]++
+		if dryRun {
+			continue
+		}
+		req := &commentSubmitRequest{
+			Permalink:   u.String(),
+			host:        u.Host,
+			path:        u.Path,
+			realIP:      p.IPAddress,
+			UserIP:      anonymizeIP(p.IPAddress),
+			Author:      p.Author.Name,
+			AuthorEmail: p.Author.Email,
+			Content:     p.Message,
+		}
+		if parent, ok := ids[p.Parent.ID]; ok {
+			req.ParentID = strconv.FormatInt(parent, 10)
+		}
+		id, err := saveComment(context.Background(), conn, req, dates[p.ID])
+		if err != nil {
+			return counts, err
+		}
+		ids[p.ID] = id
+		if _, err = approveComment(conn, u.Host, u.Path, id); err != nil {
+			return counts, err
+		}
+	}
+	msg := "Imported comments"
+	if dryRun {
+		msg = "Would import comments"
+	}
+	for page, n := range counts {
+		slog.Info(msg, "url", page, "comments", n)
+	}
+	return counts, nil
+}
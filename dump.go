@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// dumpRecord is a comment in a dump, as it's stored: its hash isn't rendered
+// or sanitized, so it can be loaded back as it was.
+type dumpRecord struct {
+	Host     string            `json:"host"`
+	Path     string            `json:"path"`
+	ID       int64             `json:"id"`
+	Score    int64             `json:"score"`
+	Approved bool              `json:"approved"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// dumpHandler streams every comment, or every comment on a host, as
+// newline-delimited JSON, for backups. Comments in the trash are left out.
+func (s *Server) dumpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	host := r.FormValue("host")
+	if host != "" {
+		var err error
+		if host, err = cleanHostname(host); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	e := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	n, err := dumpComments(conn, host, func(rec *dumpRecord) error {
+		return e.Encode(rec)
+	}, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		redisErrors.Inc()
+		slog.Error("Dumping comments failed", "host", host, "dumped", n, "err", err)
+		// The status is sent already, so break the response off instead
+		// of letting a partial dump pass for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	slog.Info("Dumped comments", "host", host, "dumped", n)
+}
+
+// dumpComments passes every comment on host, or on all hosts when host is
+// empty, to emit, page by page, calling flush after every page. It returns the
+// number of comments emitted.
+func dumpComments(conn redis.Conn, host string, emit func(*dumpRecord) error, flush func()) (int, error) {
+	prefix := "{" + keyPrefix + "://"
+	match := prefix + "*}:all"
+	if host != "" {
+		match = prefix + host + "/*}:all"
+	}
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return n, err
+		}
+		for _, key := range keys {
+			host, path := splitPage(strings.TrimSuffix(strings.TrimPrefix(key, prefix), "}:all"))
+			dumped, err := dumpPage(conn, host, path, emit)
+			n += dumped
+			if err != nil {
+				return n, err
+			}
+			flush()
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// dumpPage passes the comments of a page to emit, loading maxLimit comments
+// at a time.
+func dumpPage(conn redis.Conn, host, path string, emit func(*dumpRecord) error) (int, error) {
+	n := 0
+	for offset := 0; ; offset += maxLimit {
+		pairs, err := redis.Strings(conn.Do("ZRANGE", fmt.Sprintf(keyAll, host, path), offset, offset+maxLimit-1, "WITHSCORES"))
+		if err != nil {
+			return n, err
+		}
+		if len(pairs) == 0 {
+			return n, nil
+		}
+		records := make([]dumpRecord, len(pairs)/2)
+		for i := range records {
+			rec := &records[i]
+			rec.Host, rec.Path = host, path
+			rec.ID, _ = strconv.ParseInt(pairs[2*i], 10, 64)
+			rec.Score, _ = strconv.ParseInt(pairs[2*i+1], 10, 64)
+			conn.Send("HGETALL", fmt.Sprintf(keyComment, host, path, rec.ID))
+			conn.Send("ZSCORE", fmt.Sprintf(keyApproved, host, path), rec.ID)
+		}
+		if err = conn.Flush(); err != nil {
+			return n, err
+		}
+		for i := range records {
+			rec := &records[i]
+			if rec.Fields, err = redis.StringMap(conn.Receive()); err != nil {
+				return n, err
+			}
+			score, err := conn.Receive()
+			if err != nil {
+				return n, err
+			}
+			rec.Approved = score != nil
+		}
+		for i := range records {
+			if err = emit(&records[i]); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// loadDumpHandler loads comments from a dump made by dumpHandler, replacing
+// the stored comments with the same ids.
+func (s *Server) loadDumpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	// No maxBodySize, a dump of everything is as large as it is
+	n, err := loadDump(conn, r.Body)
+	var badDump *badDumpError
+	if errors.As(err, &badDump) {
+		http.Error(w, fmt.Sprintf("%v, after loading %d comments", err, n), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("Loading dump failed", "loaded", n, "err", err)
+		backendError(w, err)
+		return
+	}
+	slog.Info("Loaded dump", "loaded", n)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Loaded int `json:"loaded"`
+	}{n})
+}
+
+// badDumpError is a dump that doesn't parse, as opposed to failing to store
+// it.
+type badDumpError struct {
+	line int
+	err  error
+}
+
+func (e *badDumpError) Error() string {
+	return fmt.Sprintf("bad dump on line %d: %v", e.line, e.err)
+}
+
+// loadDump stores the comments of a dump read from r, and returns how many it
+// stored. Comments load one at a time, so a failure leaves the ones before it
+// stored.
+func loadDump(conn redis.Conn, r io.Reader) (int, error) {
+	d := json.NewDecoder(r)
+	for n := 0; ; n++ {
+		var rec dumpRecord
+		err := d.Decode(&rec)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err == nil {
+			err = rec.clean()
+		}
+		if err != nil {
+			return n, &badDumpError{line: n + 1, err: err}
+		}
+		if err = loadDumpRecord(conn, &rec); err != nil {
+			return n, err
+		}
+	}
+}
+
+// clean checks a record enough to not store anything unreachable, and
+// normalizes its host and path like commentURL does, so the comments end up
+// where the handlers look for them.
+func (rec *dumpRecord) clean() error {
+	host, err := cleanHostname(rec.Host)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(rec.Path, "/") {
+		return errors.New("bad path value")
+	}
+	if rec.ID <= 0 || rec.Score <= 0 || len(rec.Fields) == 0 {
+		return errors.New("missing id, score or fields")
+	}
+	u := normalizeURL(&url.URL{Scheme: "https", Host: host, Path: rec.Path})
+	rec.Host, rec.Path = u.Host, u.Path
+	return nil
+}
+
+func loadDumpRecord(conn redis.Conn, rec *dumpRecord) error {
+	host, path, id := rec.Host, rec.Path, rec.ID
+	conn.Send("MULTI")
+	conn.Send("DEL", fmt.Sprintf(keyComment, host, path, id))
+	conn.Send("HSET", redis.Args{}.Add(fmt.Sprintf(keyComment, host, path, id)).AddFlat(rec.Fields)...)
+	conn.Send("ZADD", fmt.Sprintf(keyAll, host, path), rec.Score, id)
+	if rec.Approved {
+		conn.Send("ZADD", fmt.Sprintf(keyApproved, host, path), rec.Score, id)
+	} else {
+		conn.Send("ZREM", fmt.Sprintf(keyApproved, host, path), id)
+	}
+	conn.Send("ZREM", fmt.Sprintf(keyTrash, host, path), id)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if deleted, _ := redis.Int(replies[0], nil); deleted == 0 {
+		countComment(conn, host, 1)
+	}
+	// New comments shouldn't get the id of a loaded one
+	lastID, err := redis.Int64(conn.Do("GET", fmt.Sprintf(keyLastID, host, path)))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if lastID < id {
+		if _, err = conn.Do("SET", fmt.Sprintf(keyLastID, host, path), id); err != nil {
+			return err
+		}
+	}
+	if err = indexEmail(conn, host, path, id, rec.Fields["comment_author_email"]); err != nil {
+		return err
+	}
+	if rec.Approved {
+		if err = addReply(conn, host, path, id, rec.Score); err != nil {
+			return err
+		}
+		return addRecent(conn, host, path, id, rec.Score)
+	}
+	if err = removeReply(conn, host, path, id); err != nil {
+		return err
+	}
+	return removeRecent(conn, host, path, id)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLoadDumpNormalizes(t *testing.T) {
+	s, m := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	dump := `{"host":"Example.com:443","path":"/post","id":7,"score":1709294400000,"approved":true,"fields":{"comment_author":"Alice","comment_content":"Hello"}}`
+	n, err := loadDump(conn, strings.NewReader(dump))
+	if err != nil || n != 1 {
+		t.Fatalf("loadDump = %d, %v, want 1 comment", n, err)
+	}
+	if got := m.HGet(fmt.Sprintf(keyComment, "example.com", "/post", 7), "comment_content"); got != "Hello" {
+		t.Errorf("comment_content under the normalized key = %q, want Hello", got)
+	}
+	comments, _, _, err := getComments(context.Background(), conn, "example.com", "/post", 0, defaultLimit, false, 0)
+	if err != nil || len(comments) != 1 {
+		t.Errorf("getComments = %d comments, %v, want the loaded one", len(comments), err)
+	}
+}
+
+func TestLoadDumpBadRecord(t *testing.T) {
+	s, _ := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	tests := []struct {
+		name, dump string
+	}{
+		{"bad host", `{"host":"exa mple.com","path":"/post","id":1,"score":1,"fields":{"a":"b"}}`},
+		{"relative path", `{"host":"example.com","path":"post","id":1,"score":1,"fields":{"a":"b"}}`},
+		{"no fields", `{"host":"example.com","path":"/post","id":1,"score":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadDump(conn, strings.NewReader(tt.dump)); err == nil {
+				t.Error("loadDump accepted a bad record")
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// editWindow is how long commenters can edit their comment after posting
+	editWindow = envDuration("EDIT_WINDOW", 5*time.Minute)
+
+	// cookieSecret signs cookies. Without COOKIE_SECRET, a random secret is
+	// used, so cookies stop working after a restart.
+	cookieSecret = []byte(os.Getenv("COOKIE_SECRET"))
+)
+
+func init() {
+	if len(cookieSecret) == 0 && ipAnonymization == "hash" {
+		// A random secret would hash the same IP differently after every
+		// restart, so stored IPs of the same commenter stop matching
+		fatal("IP_ANONYMIZATION=hash needs COOKIE_SECRET")
+	}
+	if len(cookieSecret) == 0 {
+		cookieSecret = make([]byte, 32)
+		if _, err := rand.Read(cookieSecret); err != nil {
+			fatal("Creating a cookie secret failed", "err", err)
+		}
+	}
+}
+
+// sign returns the hex encoded HMAC of the parts, using cookieSecret.
+func sign(parts ...string) string {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// editCookieName is unique for every comment, without giving away which
+// comment it's for.
+func editCookieName(host, path string, id int64) string {
+	return "comment_edit_" + sign("edit-name", host, path, fmt.Sprint(id))[:16]
+}
+
+// setEditCookie lets the commenter edit their comment during editWindow.
+func setEditCookie(w http.ResponseWriter, host, path string, id int64) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     editCookieName(host, path, id),
+		Value:    sign("edit", host, path, fmt.Sprint(id)),
+		Path:     "/comments/edit",
+		MaxAge:   int(editWindow / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+		// The edit form lives on another site
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+// canEdit checks r for the cookie set when the comment was posted.
+func canEdit(r *http.Request, host, path string, id int64) bool {
+	cookie, err := r.Cookie(editCookieName(host, path, id))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(sign("edit", host, path, fmt.Sprint(id))))
+}
+
+var errEditWindow = errors.New("comment can no longer be edited")
+
+func (s *Server) editHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		s.credentialsPreflight(w, r, "GET, POST")
+		return
+	}
+	conn := s.pool.Get()
+	cors, err := corsOrigin(conn, r)
+	conn.Close()
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	// Before anything else, so the page can read why an edit failed too
+	setCredentialsCORS(w, r, cors)
+	if r.Method == "GET" {
+		s.ownCommentHandler(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err = parseBody(w, r)
+	if err == errTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		return
+	}
+	req, err := cleanModerationRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	content := r.FormValue("comment_content")
+	if content == "" {
+		http.Error(w, "bad comment_content value", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(content) > maxContentLength {
+		http.Error(w, "comment_content too long", http.StatusBadRequest)
+		return
+	}
+	held, err := checkLinks(content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canEdit(r, req.host, req.path, req.id) {
+		http.Error(w, "not your comment", http.StatusForbidden)
+		return
+	}
+	conn = s.pool.Get()
+	defer conn.Close()
+	blocked, err := hasBlockedWord(conn, content)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if blocked {
+		http.Error(w, "comment rejected", http.StatusForbidden)
+		return
+	}
+	content, err = cleanProfanity(conn, content)
+	if err == errProfanity {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	editedAt, err := editComment(conn, req.host, req.path, req.id, content, s.now())
+	if err == errNoComment {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err == errEditWindow {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	slog.Info("Edited comment", "host", req.host, "path", req.path, "id", req.id)
+	if held != "" {
+		// Just like a new comment with that many links
+		if _, err = unapproveComment(conn, req.host, req.path, req.id); err == nil {
+			err = holdComment(conn, req.host, req.path, req.id, held)
+		}
+		if err != nil {
+			redisErrors.Inc()
+			slog.Error("Holding edited comment failed", "host", req.host, "path", req.path, "id", req.id, "err", err)
+		}
+	}
+	s.recheckComment(conn, req.host, req.path, req.id)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		ID       int64  `json:"id"`
+		EditedAt string `json:"edited_at"`
+	}{req.id, editedAt})
+}
+
+// ownComment is a comment as its author gets to see it
+type ownComment struct {
+	comment
+	Approved bool `json:"approved"`
+}
+
+// ownCommentHandler shows commenters their comment while they can edit it,
+// approved or not, so the page can say it's awaiting moderation. editHandler
+// already set the CORS headers.
+func (s *Server) ownCommentHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := cleanModerationRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canEdit(r, req.host, req.path, req.id) {
+		http.Error(w, "not your comment", http.StatusForbidden)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	score, err := redis.String(conn.Do("ZSCORE", fmt.Sprintf(keyAll, req.host, req.path), req.id))
+	if err == redis.ErrNil {
+		http.Error(w, errNoComment.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	loaded, err := loadComments(conn, req.host, req.path, []string{fmt.Sprint(req.id), score})
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	approved, err := isApproved(conn, req.host, req.path, req.id)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	e := json.NewEncoder(w)
+	e.Encode(ownComment{
+		comment:  loaded[0].comment,
+		Approved: approved,
+	})
+}
+
+// editComment replaces the content of a comment posted less than editWindow
+// before now, and returns the time of the edit.
+func editComment(conn redis.Conn, host, path string, id int64, content string, now time.Time) (string, error) {
+	score, err := redis.Float64(conn.Do("ZSCORE", fmt.Sprintf(keyAll, host, path), id))
+	if err == redis.ErrNil {
+		return "", errNoComment
+	}
+	if err != nil {
+		return "", err
+	}
+	if now.Sub(scoreTime(score)) > editWindow {
+		return "", errEditWindow
+	}
+	editedAt := now.UTC().Format(timeFormat)
+	_, err = conn.Do("HMSET", fmt.Sprintf(keyComment, host, path, id),
+		"comment_content", content,
+		"edited_at", editedAt)
+	return editedAt, err
+}
+
+// recheckComment runs an edited comment through Akismet again, and
+// unapproves it when it turned into spam. It never approves anything, so
+// comments held for another reason or unapproved by a moderator stay that way.
+// When Akismet fails, an approved comment is held for moderation, like
+// autoApproveComment fails closed.
+func (s *Server) recheckComment(conn redis.Conn, host, path string, id int64) {
+	if s.akismetKeyFor(host) == "" {
+		return
+	}
+	isSpam, _, err := s.akismetCheck(conn, host, path, id, "")
+	if err == nil && !isSpam {
+		return
+	}
+	removed, uerr := unapproveComment(conn, host, path, id)
+	if uerr != nil {
+		redisErrors.Inc()
+		slog.Error("Unapproving edited comment failed", "host", host, "path", path, "id", id, "err", uerr)
+		return
+	}
+	if err != nil {
+		slog.Warn("Rechecking edited comment failed", "host", host, "path", path, "id", id, "err", err)
+		if !removed {
+			// Pending already, with its own held_reason
+			return
+		}
+		if err = holdComment(conn, host, path, id, heldAkismetError); err != nil {
+			redisErrors.Inc()
+			slog.Error("Holding comment failed", "host", host, "path", path, "id", id, "err", err)
+		}
+		return
+	}
+	if removed {
+		slog.Info("Unapproved edited comment", "host", host, "path", path, "id", id, "outcome", "spam")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// editTestComment edits a comment on https://example.com/post with the cookie
+// of its author.
+func editTestComment(s *Server, id int64, content string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	setEditCookie(rec, "example.com", "/post", id)
+	cookie := rec.Result().Cookies()[0]
+	return testRequest(s, "POST", "/comments/edit", url.Values{
+		"url":             {"https://example.com/post"},
+		"id":              {fmt.Sprint(id)},
+		"comment_content": {content},
+	}, http.Header{"Cookie": {cookie.Name + "=" + cookie.Value}})
+}
+
+func TestEditRecheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		answer   string
+		approved bool
+		held     string
+		want     bool
+	}{
+		{"ham stays held", "false", false, heldReservedName, false},
+		{"ham stays approved", "false", true, "", true},
+		{"spam is unapproved", "true", true, "", false},
+		{"failure holds", "invalid", true, "", false},
+		{"failure keeps reason", "invalid", false, heldReservedName, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m := newTestServer(t)
+			fakeAkismet(t, s, tt.answer)
+			conn := s.pool.Get()
+			id := saveTestComment(t, conn, "Alice", "Hello", tt.approved)
+			if tt.held != "" {
+				holdComment(conn, "example.com", "/post", id, tt.held)
+			}
+			conn.Close()
+			if w := editTestComment(s, id, "Hello, world"); w.Code != http.StatusOK {
+				t.Fatalf("edit status = %d, want 200: %s", w.Code, w.Body)
+			}
+			conn = s.pool.Get()
+			defer conn.Close()
+			if approved, _ := isApproved(conn, "example.com", "/post", id); approved != tt.want {
+				t.Errorf("approved after edit = %t, want %t", approved, tt.want)
+			}
+			wantHeld := tt.held
+			if tt.answer == "invalid" && tt.approved {
+				wantHeld = heldAkismetError
+			}
+			if got := m.HGet(fmt.Sprintf(keyComment, "example.com", "/post", id), "held_reason"); got != wantHeld {
+				t.Errorf("held_reason = %q, want %q", got, wantHeld)
+			}
+		})
+	}
+}
+
+func TestEditTooManyLinks(t *testing.T) {
+	defer func(n int, action string) { maxLinks, maxLinksAction = n, action }(maxLinks, maxLinksAction)
+	maxLinks = 1
+	links := "https://a.example and https://b.example"
+
+	s, m := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	id := saveTestComment(t, conn, "Alice", "Hello", true)
+	key := fmt.Sprintf(keyComment, "example.com", "/post", id)
+
+	maxLinksAction = "reject"
+	if w := editTestComment(s, id, links); w.Code != http.StatusBadRequest {
+		t.Errorf("edit status = %d, want 400", w.Code)
+	}
+	if got := m.HGet(key, "comment_content"); got != "Hello" {
+		t.Errorf("content = %q after a rejected edit", got)
+	}
+
+	maxLinksAction = "hold"
+	if w := editTestComment(s, id, links); w.Code != http.StatusOK {
+		t.Fatalf("edit status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if approved, _ := isApproved(conn, "example.com", "/post", id); approved {
+		t.Error("comment edited to too many links is still approved")
+	}
+	if got := m.HGet(key, "held_reason"); got != heldTooManyLinks {
+		t.Errorf("held_reason = %q, want %q", got, heldTooManyLinks)
+	}
+}
+
+func TestEditCORS(t *testing.T) {
+	defer func(origins []string) { corsOrigins = origins }(corsOrigins)
+	corsOrigins = []string{"https://example.com"}
+	s, _ := newTestServer(t)
+	conn := s.pool.Get()
+	id := saveTestComment(t, conn, "Alice", "Hello", false)
+	conn.Close()
+	rec := httptest.NewRecorder()
+	setEditCookie(rec, "example.com", "/post", id)
+	cookie := rec.Result().Cookies()[0]
+
+	tests := []struct {
+		name   string
+		method string
+		form   url.Values
+		cookie bool
+		code   int
+	}{
+		{"preflight", "OPTIONS", nil, false, http.StatusNoContent},
+		{"own comment", "GET", url.Values{"url": {"https://example.com/post"}, "id": {fmt.Sprint(id)}}, true, http.StatusOK},
+		{"not your comment", "GET", url.Values{"url": {"https://example.com/post"}, "id": {fmt.Sprint(id)}}, false, http.StatusForbidden},
+		{"edit", "POST", url.Values{"url": {"https://example.com/post"}, "id": {fmt.Sprint(id)}, "comment_content": {"Hi"}}, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Origin": {"https://example.com"}}
+			if tt.cookie {
+				header.Set("Cookie", cookie.Name+"="+cookie.Value)
+			}
+			w := testRequest(s, tt.method, "/comments/edit", tt.form, header)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+				t.Errorf("Access-Control-Allow-Origin = %q, want https://example.com", got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"html"
+	"net/http"
+	"time"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedHandler serves the newest approved comments of a page as an Atom feed.
+func (s *Server) feedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := commentURL(r)
+	if err != nil || u.Host == "" {
+		http.Error(w, "bad URL", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), redisTimeout)
+	defer cancel()
+	conn := s.pool.Get()
+	defer conn.Close()
+	count, err := countComments(conn, u.Host, u.Path)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	// Comments are listed oldest first, so skip to the last page
+	offset := count - maxLimit
+	if offset < 0 {
+		offset = 0
+	}
+	comments, _, _, err := getComments(ctx, conn, u.Host, u.Path, offset, maxLimit, false, 0)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	permalink := u.String()
+	feed := atomFeed{
+		ID:      permalink,
+		Title:   "Comments on " + u.Host + u.Path,
+		Updated: s.now().UTC().Format(time.RFC3339),
+		Link:    atomLink{Href: permalink},
+	}
+	if len(comments) > 0 {
+		feed.Updated = comments[len(comments)-1].CreatedAt
+	}
+	// Newest first, like feed readers expect
+	for i := len(comments) - 1; i >= 0; i-- {
+		c := comments[i]
+		author := html.UnescapeString(c.Author)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      permalink + "#" + anchorPrefix + c.ID,
+			Title:   "Comment by " + author,
+			Updated: c.CreatedAt,
+			Author:  atomAuthor{Name: author},
+			Link:    atomLink{Href: permalink + "#" + anchorPrefix + c.ID},
+			Content: atomContent{Type: "html", Body: c.Content},
+		})
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	e := xml.NewEncoder(w)
+	e.Encode(feed)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFeedAnchorPrefix(t *testing.T) {
+	defer func(prefix string) { anchorPrefix = prefix }(anchorPrefix)
+	anchorPrefix = "c"
+	s, _ := newTestServer(t)
+	conn := s.pool.Get()
+	id := saveTestComment(t, conn, "Alice", "Hello", true)
+	conn.Close()
+	w := testRequest(s, "GET", "/comments/feed", url.Values{"url": {"https://example.com/post"}}, nil)
+	want := fmt.Sprintf("https://example.com/post#c%d", id)
+	if body := w.Body.String(); !strings.Contains(body, "<id>"+want+"</id>") || !strings.Contains(body, `href="`+want+`"`) {
+		t.Errorf("feed doesn't link to %s:\n%s", want, body)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinSize is the response size from which GET responses are compressed,
+// smaller responses don't get much smaller.
+var gzipMinSize = envInt("GZIP_MIN_SIZE", 1400)
+
+// gzipped wraps h to compress its responses to GET requests, for clients
+// accepting gzip.
+func gzipped(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			h(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		h(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding of r includes gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		// gzip;q=0 means anything but gzip
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// gzipWriter holds back the response until it's known whether it reaches
+// gzipMinSize.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	// started is set once the status is written, gz when compressing
+	started bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if !w.started {
+		w.status = status
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	if w.started {
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < gzipMinSize {
+		return len(p), nil
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.started = true
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return len(p), err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return len(p), err
+}
+
+// close writes out a response that stayed below gzipMinSize, or finishes
+// the compressed one.
+func (w *gzipWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		return
+	}
+	if !w.started {
+		w.started = true
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logLevel is the minimum level of logs, like debug or warn. The log package
+// logs at info, which is the default.
+var logLevel = envString("LOG_LEVEL", "info")
+
+func init() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		fatal("bad LOG_LEVEL value", "value", logLevel, "err", err)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+	})))
+}
+
+// fatal logs msg with args as an error, and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
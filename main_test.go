@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+)
+
+// testNow is the clock of test servers
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestServer returns a Server backed by a fresh miniredis, without Akismet
+// or StopForumSpam, and the miniredis to look into.
+func newTestServer(t *testing.T) (*Server, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	s := newServer(&redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", m.Addr())
+		},
+	})
+	t.Cleanup(func() { s.pool.Close() })
+	s.akismetKey = ""
+	s.akismetKeys = nil
+	s.stopForumSpamURL = ""
+	s.now = func() time.Time { return testNow }
+	return s, m
+}
+
+// testRequest runs a request with form as its body, or for GET, its query,
+// through the handler of s.
+func testRequest(s *Server, method, target string, form url.Values, header http.Header) *httptest.ResponseRecorder {
+	var r *http.Request
+	if method == "GET" {
+		if form != nil {
+			target += "?" + form.Encode()
+		}
+		r = httptest.NewRequest(method, target, nil)
+	} else {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+// testComment returns a comment submission for https://example.com/post.
+func testComment(author, content string) *commentSubmitRequest {
+	return &commentSubmitRequest{
+		Permalink: "https://example.com/post",
+		host:      "example.com",
+		path:      "/post",
+		realIP:    "192.0.2.1",
+		UserIP:    "192.0.2.1",
+		Author:    author,
+		Content:   content,
+	}
+}
+
+// saveTestComment saves a comment on https://example.com/post, approved or
+// pending.
+func saveTestComment(t *testing.T, conn redis.Conn, author, content string, approved bool) int64 {
+	t.Helper()
+	id, err := saveComment(context.Background(), conn, testComment(author, content), testNow)
+	if err != nil {
+		t.Fatalf("saveComment: %v", err)
+	}
+	if approved {
+		if _, err = approveComment(conn, "example.com", "/post", id); err != nil {
+			t.Fatalf("approveComment: %v", err)
+		}
+	}
+	return id
+}
+
+func TestGetCommentsEmpty(t *testing.T) {
+	s, _ := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	comments, hasMore, _, err := getComments(context.Background(), conn, "example.com", "/nothing", 0, defaultLimit, false, 0)
+	if err != nil {
+		t.Fatalf("getComments: %v", err)
+	}
+	if comments == nil || len(comments) != 0 || hasMore {
+		t.Errorf("getComments = %#v, %t, want an empty list without more", comments, hasMore)
+	}
+
+	w := testRequest(s, "GET", "/comments/", url.Values{"url": {"https://example.com/nothing"}}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET status = %d, want 200", w.Code)
+	}
+	// An empty array, not null, so themes can loop over it
+	if !strings.Contains(w.Body.String(), `"comments":[]`) {
+		t.Errorf("GET body = %s, want an empty comments array", w.Body)
+	}
+}
+
+func TestSaveComment(t *testing.T) {
+	s, m := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	for want := int64(1); want <= 2; want++ {
+		id, err := saveComment(context.Background(), conn, testComment("Alice", "Hello"), testNow)
+		if err != nil {
+			t.Fatalf("saveComment: %v", err)
+		}
+		if id != want {
+			t.Errorf("saveComment id = %d, want %d", id, want)
+		}
+	}
+	score, err := m.ZScore("{luit.eu/comments://example.com/post}:all", "1")
+	if err != nil || int64(score) != testNow.UnixMilli() {
+		t.Errorf(":all score = %v, %v, want %d", score, err, testNow.UnixMilli())
+	}
+	if m.Exists("{luit.eu/comments://example.com/post}:approved") {
+		t.Error("saved comment is approved, want it pending")
+	}
+	key := "{luit.eu/comments://example.com/post}:comment:1"
+	for field, want := range map[string]string{
+		"comment_author":  "Alice",
+		"comment_content": "Hello",
+		"permalink":       "https://example.com/post",
+		"user_ip":         "192.0.2.1",
+		"created_at":      "2024-03-01T12:00:00.000Z",
+	} {
+		if got := m.HGet(key, field); got != want {
+			t.Errorf("%s = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestAutoEnabled(t *testing.T) {
+	s, m := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	ctx := context.Background()
+	m.SAdd("{luit.eu/comments}:auto_enable", "auto.example.com")
+	m.Set("{luit.eu/comments://auto.example.com/closed}:enabled", "false")
+	tests := []struct {
+		host, path string
+		want       bool
+		// stored is the :enabled key afterwards, empty when there's none
+		stored string
+	}{
+		{"example.com", "/post", false, ""},
+		{"auto.example.com", "/post", true, "true"},
+		{"auto.example.com", "/closed", false, "false"},
+	}
+	for _, tt := range tests {
+		en, err := autoEnabled(ctx, conn, tt.host, tt.path)
+		if err != nil {
+			t.Fatalf("autoEnabled(%s%s): %v", tt.host, tt.path, err)
+		}
+		if en != tt.want {
+			t.Errorf("autoEnabled(%s%s) = %t, want %t", tt.host, tt.path, en, tt.want)
+		}
+		key := fmt.Sprintf(keyEnabled, tt.host, tt.path)
+		stored, _ := m.Get(key)
+		if stored != tt.stored {
+			t.Errorf("%s = %q, want %q", key, stored, tt.stored)
+		}
+	}
+}
+
+func TestApprovedComments(t *testing.T) {
+	s, _ := newTestServer(t)
+	conn := s.pool.Get()
+	approved := saveTestComment(t, conn, "Alice", "Approved", true)
+	pending := saveTestComment(t, conn, "Bob", "Pending", false)
+	conn.Close()
+
+	w := testRequest(s, "GET", "/comments/", url.Values{"url": {"https://example.com/post"}}, nil)
+	var list commentList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if len(list.Comments) != 1 || list.Comments[0].ID != fmt.Sprint(approved) {
+		t.Errorf("GET comments = %+v, want only comment %d", list.Comments, approved)
+	}
+
+	w = testRequest(s, "GET", "/comments/count", url.Values{"url": {"https://example.com/post"}}, nil)
+	if got := strings.TrimSpace(w.Body.String()); got != `{"count":1}` {
+		t.Errorf("count = %s, want 1", got)
+	}
+
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+	w = testRequest(s, "GET", "/comments/pending", url.Values{"url": {"https://example.com/post"}},
+		http.Header{"Authorization": {"Bearer secret"}})
+	var pendingList struct {
+		Comments []fullComment `json:"comments"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &pendingList); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if len(pendingList.Comments) != 1 || pendingList.Comments[0].ID != fmt.Sprint(pending) {
+		t.Errorf("pending comments = %+v, want only comment %d", pendingList.Comments, pending)
+	}
+}
+
+func TestPostComment(t *testing.T) {
+	s, m := newTestServer(t)
+	m.SAdd("{luit.eu/comments}:auto_enable", "example.com")
+	w := testRequest(s, "POST", "/comments/", url.Values{
+		"url":             {"https://example.com/post?utm_source=feed"},
+		"comment_author":  {"Alice"},
+		"comment_content": {"Hello"},
+	}, nil)
+	s.background.Wait()
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST status = %d, want 303: %s", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Location"), "https://example.com/post#comment-1"; got != want {
+		t.Errorf("redirect = %q, want %q", got, want)
+	}
+	if got := m.HGet("{luit.eu/comments://example.com/post}:comment:1", "comment_content"); got != "Hello" {
+		t.Errorf("stored content = %q, want Hello", got)
+	}
+	// Without Akismet nothing approves it
+	if m.Exists("{luit.eu/comments://example.com/post}:approved") {
+		t.Error("comment approved without a spam check")
+	}
+
+	m.Set("{luit.eu/comments://example.com/closed}:enabled", "false")
+	w = testRequest(s, "POST", "/comments/", url.Values{
+		"url":             {"https://example.com/closed"},
+		"comment_author":  {"Alice"},
+		"comment_content": {"Hello again"},
+	}, nil)
+	s.background.Wait()
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST on a closed page status = %d, want 400", w.Code)
+	}
+}
+
+func TestPostCommentSpamCheckSkipped(t *testing.T) {
+	s, m := newTestServer(t)
+	fakeAkismet(t, s, "false")
+	// Nothing ever takes from it, like every worker is busy
+	s.spamChecks = make(chan struct{})
+	m.SAdd("{luit.eu/comments}:auto_enable", "example.com")
+	w := testRequest(s, "POST", "/comments/", url.Values{
+		"url":             {"https://example.com/post"},
+		"comment_author":  {"Alice"},
+		"comment_content": {"Hello"},
+	}, nil)
+	s.background.Wait()
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST status = %d, want 303: %s", w.Code, w.Body)
+	}
+	if got := m.HGet("{luit.eu/comments://example.com/post}:comment:1", "held_reason"); got != heldSpamCheckSkipped {
+		t.Errorf("held_reason = %q, want %q", got, heldSpamCheckSkipped)
+	}
+	if m.Exists("{luit.eu/comments://example.com/post}:approved") {
+		t.Error("comment approved without a spam check")
+	}
+}
+
+// dropConn is a connection that drops before sending the command named
+// dropAt, after sending all the commands queued before it, like a process
+// dying in the middle of a pipeline.
+type dropConn struct {
+	redis.Conn
+	dropAt string
+}
+
+func (c *dropConn) drop(cmd string) {
+	if cmd == c.dropAt {
+		c.Conn.Flush()
+		c.Conn.Close()
+	}
+}
+
+func (c *dropConn) Send(cmd string, args ...interface{}) error {
+	c.drop(cmd)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *dropConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.drop(cmd)
+	return c.Conn.Do(cmd, args...)
+}
+
+func TestSaveCommentDropped(t *testing.T) {
+	for _, dropAt := range []string{"HMSET", "ZADD", "EXEC"} {
+		t.Run(dropAt, func(t *testing.T) {
+			_, m := newTestServer(t)
+			c, err := redis.Dial("tcp", m.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &dropConn{Conn: c, dropAt: dropAt}
+			if _, err = saveComment(context.Background(), conn, testComment("Alice", "Hello"), testNow); err == nil {
+				t.Fatal("saveComment succeeded on a dropped connection")
+			}
+			for _, key := range []string{
+				"{luit.eu/comments://example.com/post}:all",
+				"{luit.eu/comments://example.com/post}:approved",
+				"{luit.eu/comments://example.com/post}:comment:1",
+			} {
+				if m.Exists(key) {
+					t.Errorf("%s exists after a failed save", key)
+				}
+			}
+		})
+	}
+}
+
+// fakeAkismet starts an Akismet that answers every comment check with answer,
+// and points s at it. It returns a function listing the submit-spam and
+// submit-ham requests it got so far.
+func fakeAkismet(t *testing.T, s *Server, answer string) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var submitted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("api_key") != "test-key" || r.FormValue("comment_content") == "" {
+			t.Errorf("akismet request without key or comment: %v", r.Form)
+		}
+		switch r.URL.Path {
+		case akismetCheckPath:
+			w.Write([]byte(answer))
+		case akismetSubmitSpamPath, akismetSubmitHamPath:
+			mu.Lock()
+			submitted = append(submitted, r.URL.Path)
+			mu.Unlock()
+			w.Write([]byte("Thanks for making the web a better place."))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	s.akismetKey = "test-key"
+	s.akismetURL = ts.URL
+	s.client = ts.Client()
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), submitted...)
+	}
+}
+
+func TestAutoApproveComment(t *testing.T) {
+	tests := []struct {
+		answer   string
+		approved bool
+		err      bool
+		result   string
+		held     string
+	}{
+		{answer: "false", approved: true, result: "ham"},
+		{answer: "true", approved: false, result: "spam"},
+		{answer: "invalid", approved: false, err: true, held: heldAkismetError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			s, m := newTestServer(t)
+			fakeAkismet(t, s, tt.answer)
+			conn := s.pool.Get()
+			defer conn.Close()
+			id := saveTestComment(t, conn, "Alice", "Hello", false)
+			approved, err := s.autoApproveComment(context.Background(), conn, "example.com", "/post", id, "192.0.2.1")
+			if (err != nil) != tt.err {
+				t.Errorf("autoApproveComment error = %v, want error %t", err, tt.err)
+			}
+			if approved != tt.approved {
+				t.Errorf("autoApproveComment approved = %t, want %t", approved, tt.approved)
+			}
+			inApproved, _ := isApproved(conn, "example.com", "/post", id)
+			if inApproved != tt.approved {
+				t.Errorf("in :approved = %t, want %t", inApproved, tt.approved)
+			}
+			// Spam is only discarded when Akismet says so
+			if _, err = m.ZScore("{luit.eu/comments://example.com/post}:all", fmt.Sprint(id)); err != nil {
+				t.Errorf("comment gone from :all: %v", err)
+			}
+			key := fmt.Sprintf(keyComment, "example.com", "/post", id)
+			if got := m.HGet(key, "akismet_result"); got != tt.result {
+				t.Errorf("akismet_result = %q, want %q", got, tt.result)
+			}
+			if got := m.HGet(key, "held_reason"); got != tt.held {
+				t.Errorf("held_reason = %q, want %q", got, tt.held)
+			}
+		})
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		strip  bool
+		want   string
+	}{
+		{"https://example.com/post", false, "https://example.com/post"},
+		{"https://example.com/post/", false, "https://example.com/post/"},
+		{"https://example.com/post/", true, "https://example.com/post"},
+		{"https://example.com/", true, "https://example.com/"},
+		{"https://example.com", false, "https://example.com/"},
+		{"https://example.com:443/post", false, "https://example.com/post"},
+		{"http://example.com:80/post", false, "http://example.com/post"},
+		{"https://example.com:80/post", false, "https://example.com:80/post"},
+		{"https://example.com:8443/post", false, "https://example.com:8443/post"},
+		{"https://EXAMPLE.com/Post", false, "https://example.com/Post"},
+		{"https://example.com/post?utm_source=feed&id=1", false, "https://example.com/post"},
+		{"https://example.com/post?", false, "https://example.com/post"},
+		{"https://example.com/post#comment-3", false, "https://example.com/post"},
+		{"https://Example.com:443/post/?utm_source=feed#top", true, "https://example.com/post"},
+		{"https://example.com/caf%C3%A9", false, "https://example.com/caf%C3%A9"},
+	}
+	defer func(strip bool) { stripTrailingSlash = strip }(stripTrailingSlash)
+	for _, tt := range tests {
+		stripTrailingSlash = tt.strip
+		u, err := url.Parse(tt.rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := normalizeURL(u).String(); got != tt.want {
+			t.Errorf("normalizeURL(%s) with strip %t = %s, want %s", tt.rawURL, tt.strip, got, tt.want)
+		}
+	}
+}
+
+func TestPostCommentRetry(t *testing.T) {
+	s, m := newTestServer(t)
+	m.SAdd("{luit.eu/comments}:auto_enable", "example.com")
+	form := url.Values{
+		"url":             {"https://example.com/post"},
+		"comment_author":  {"Alice"},
+		"comment_content": {"Hello"},
+	}
+	m.HSet(keyQuotas, "example.com", "1")
+	m.Set(fmt.Sprintf(keyHostCount, "example.com"), "1")
+	if w := testRequest(s, "POST", "/comments/", form, nil); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("POST over quota status = %d, want 507", w.Code)
+	}
+	// Not a duplicate of the one that wasn't saved
+	m.HSet(keyQuotas, "example.com", "0")
+	w := testRequest(s, "POST", "/comments/", form, nil)
+	s.background.Wait()
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "https://example.com/post#comment-1" {
+		t.Fatalf("retry status = %d, redirect %q, want the new comment", w.Code, w.Header().Get("Location"))
+	}
+	// A double click is, once it's saved
+	w = testRequest(s, "POST", "/comments/", form, nil)
+	if w.Header().Get("Location") != "https://example.com/post" {
+		t.Errorf("double post redirect = %q, want the page", w.Header().Get("Location"))
+	}
+	if n, _ := m.ZMembers("{luit.eu/comments://example.com/post}:all"); len(n) != 1 {
+		t.Errorf("comments saved = %v, want 1", n)
+	}
+}
+
+func TestPostCommentCooldown(t *testing.T) {
+	defer func(d time.Duration) { cooldown = d }(cooldown)
+	cooldown = time.Minute
+	s, m := newTestServer(t)
+	m.SAdd("{luit.eu/comments}:auto_enable", "example.com")
+	post := func(content string) *httptest.ResponseRecorder {
+		w := testRequest(s, "POST", "/comments/", url.Values{
+			"url":                  {"https://example.com/post"},
+			"comment_author":       {"Alice"},
+			"comment_author_email": {"alice@example.com"},
+			"comment_content":      {content},
+		}, nil)
+		s.background.Wait()
+		return w
+	}
+	m.HSet(keyQuotas, "example.com", "1")
+	m.Set(fmt.Sprintf(keyHostCount, "example.com"), "1")
+	if w := post("Hello"); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("POST over quota status = %d, want 507", w.Code)
+	}
+	// The comment that wasn't saved doesn't count
+	m.HSet(keyQuotas, "example.com", "0")
+	if w := post("Hello"); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST status = %d, want 303: %s", w.Code, w.Body)
+	}
+	w := post("Hello again")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("POST during cooldown status = %d, Retry-After %q, want 429 after 60", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	trustedProxies = parseTrustedProxies("127.0.0.1,::1,10.0.0.0/8")
+	tests := []struct {
+		remoteAddr, forwarded, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// Made up by the client
+		{"192.0.2.1:1234", "203.0.113.9", "192.0.2.1"},
+		{"127.0.0.1:1234", "192.0.2.1", "192.0.2.1"},
+		{"[::1]:1234", "2001:db8::1", "2001:db8::1"},
+		// The client's own entry comes before the one the proxy adds
+		{"127.0.0.1:1234", "203.0.113.9, 192.0.2.1", "192.0.2.1"},
+		{"127.0.0.1:1234", "192.0.2.1, 10.1.2.3", "192.0.2.1"},
+		{"127.0.0.1:1234", "", "127.0.0.1"},
+		{"127.0.0.1:1234", "garbage", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/comments/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		got, err := clientIP(r)
+		if err != nil || got != tt.want {
+			t.Errorf("clientIP(%s, X-Forwarded-For %q) = %q, %v, want %q", tt.remoteAddr, tt.forwarded, got, err, tt.want)
+		}
+	}
+}
+
+func TestPostCommentBlockedIP(t *testing.T) {
+	s, m := newTestServer(t)
+	m.SAdd("{luit.eu/comments}:auto_enable", "example.com")
+	m.SAdd(keyBlockedIPs, "192.0.2.0/24")
+	w := testRequest(s, "POST", "/comments/", url.Values{
+		"url":             {"https://example.com/post"},
+		"comment_author":  {"Alice"},
+		"comment_content": {"Hello"},
+	}, http.Header{"X-Forwarded-For": {"203.0.113.9"}})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST from a blocked IP with its own X-Forwarded-For status = %d, want 403", w.Code)
+	}
+	if m.Exists("{luit.eu/comments://example.com/post}:all") {
+		t.Error("comment from a blocked IP saved")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// rememberAuthor is how long the author fields of a comment are remembered in
+// a cookie, to fill in the form next time. Zero, the default, doesn't set the
+// cookie.
+var rememberAuthor = envDuration("REMEMBER_AUTHOR", 0)
+
+// authorCookieName is the name of the cookie remembering the author fields
+const authorCookieName = "comment_author"
+
+// rememberedAuthor is what the author cookie holds
+type rememberedAuthor struct {
+	Author      string `json:"author"`
+	AuthorEmail string `json:"author_email"`
+	AuthorURL   string `json:"author_url"`
+}
+
+// setAuthorCookie remembers the author fields of req, signed so the cookie
+// can't be changed to fill in someone else's details.
+func setAuthorCookie(w http.ResponseWriter, req *commentSubmitRequest) {
+	if rememberAuthor <= 0 {
+		return
+	}
+	data, err := json.Marshal(rememberedAuthor{
+		Author:      req.Author,
+		AuthorEmail: req.AuthorEmail,
+		AuthorURL:   req.AuthorURL,
+	})
+	if err != nil {
+		return
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     authorCookieName,
+		Value:    payload + "." + sign("author", payload),
+		Path:     "/comments/",
+		MaxAge:   int(rememberAuthor / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+		// The form lives on another site
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+// authorFromCookie returns the author fields remembered in r's cookie, or
+// nothing when there's no valid cookie.
+func authorFromCookie(r *http.Request) (rememberedAuthor, bool) {
+	var author rememberedAuthor
+	cookie, err := r.Cookie(authorCookieName)
+	if err != nil {
+		return author, false
+	}
+	payload, mac, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(sign("author", payload))) {
+		return author, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &author) != nil {
+		return author, false
+	}
+	return author, true
+}
+
+// meHandler returns the remembered author fields, empty when there are none,
+// and forgets them on DELETE.
+func (s *Server) meHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		s.credentialsPreflight(w, r, "GET, DELETE")
+		return
+	}
+	conn := s.pool.Get()
+	cors, err := corsOrigin(conn, r)
+	conn.Close()
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	// The cookie only comes along on credentialed requests
+	setCredentialsCORS(w, r, cors)
+	switch r.Method {
+	case "GET":
+		author, _ := authorFromCookie(r)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, no-store")
+		e := json.NewEncoder(w)
+		e.Encode(author)
+	case "DELETE":
+		http.SetCookie(w, &http.Cookie{
+			Name:     authorCookieName,
+			Path:     "/comments/",
+			MaxAge:   -1,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
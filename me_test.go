@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMeCORS(t *testing.T) {
+	defer func(origins []string) { corsOrigins = origins }(corsOrigins)
+	tests := []struct {
+		name    string
+		origins []string
+		method  string
+		origin  string
+		want    string
+	}{
+		{"allowed origin", []string{"https://example.com"}, "GET", "https://example.com", "https://example.com"},
+		{"other origin", []string{"https://example.com"}, "GET", "https://evil.example", ""},
+		{"wildcard", nil, "GET", "https://evil.example", ""},
+		{"delete", []string{"https://example.com"}, "DELETE", "https://example.com", "https://example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corsOrigins = tt.origins
+			s, _ := newTestServer(t)
+			w := testRequest(s, tt.method, "/comments/me", nil, http.Header{"Origin": {tt.origin}})
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.want)
+			}
+			wantCredentials := ""
+			if tt.want != "" {
+				wantCredentials = "true"
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, wantCredentials)
+			}
+			if got := w.Header().Get("Vary"); got != "Origin" {
+				t.Errorf("Vary = %q, want Origin", got)
+			}
+		})
+	}
+}
+
+func TestMePreflight(t *testing.T) {
+	defer func(origins []string) { corsOrigins = origins }(corsOrigins)
+	corsOrigins = []string{"https://example.com"}
+	s, _ := newTestServer(t)
+	w := testRequest(s, "OPTIONS", "/comments/me", nil, http.Header{"Origin": {"https://example.com"}})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight status = %d, want 204", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, DELETE" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want GET, DELETE", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+	corsOrigins = nil
+	if w := testRequest(s, "OPTIONS", "/comments/me", nil, http.Header{"Origin": {"https://evil.example"}}); w.Code != http.StatusForbidden {
+		t.Errorf("wildcard preflight status = %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	commentsSubmitted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "comments_submitted_total",
+		Help: "Number of comments saved.",
+	})
+	commentsApproved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "comments_approved_total",
+		Help: "Number of comments approved, by akismet, trusted (commenter) or admin.",
+	}, []string{"by"})
+	commentsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "comments_rejected_total",
+		Help: "Number of comments rejected as spam, by Akismet or manually.",
+	})
+	akismetChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "comments_akismet_checks_total",
+		Help: "Number of Akismet comment checks, by outcome (spam, ham or error).",
+	}, []string{"outcome"})
+	stopForumSpamChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "comments_stopforumspam_checks_total",
+		Help: "Number of StopForumSpam lookups, by outcome (spam, ham, cached or error).",
+	}, []string{"outcome"})
+	redisErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "comments_redis_errors_total",
+		Help: "Number of Redis errors.",
+	})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "comments_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		commentsSubmitted,
+		commentsApproved,
+		commentsRejected,
+		akismetChecks,
+		stopForumSpamChecks,
+		redisErrors,
+		requestDuration,
+	)
+}
+
+// instrument wraps h to record its latency as handler name.
+func instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		requestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+}
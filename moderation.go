@@ -0,0 +1,623 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mssola/useragent"
+)
+
+var (
+	adminToken = os.Getenv("ADMIN_TOKEN")
+)
+
+// authorized checks the request's bearer token against ADMIN_TOKEN. Without
+// ADMIN_TOKEN set, nobody is authorized.
+func authorized(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// moderationRequest identifies a single comment to act on
+type moderationRequest struct {
+	host string
+	path string
+	id   int64
+}
+
+func cleanModerationRequest(r *http.Request) (*moderationRequest, error) {
+	u, err := commentURL(r)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("bad url value")
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("bad id value")
+	}
+	return &moderationRequest{
+		host: u.Host,
+		path: u.Path,
+		id:   id,
+	}, nil
+}
+
+// moderationResult is the response to a moderation action
+type moderationResult struct {
+	ID       int64 `json:"id"`
+	Approved bool  `json:"approved"`
+	Changed  bool  `json:"changed"`
+}
+
+var errNoComment = errors.New("no such comment")
+
+func (s *Server) approveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := cleanModerationRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, req.host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	added, err := approveComment(conn, req.host, req.path, req.id)
+	if err == errNoComment {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if added {
+		slog.Info("Approved comment", "host", req.host, "path", req.path, "id", req.id)
+		commentsApproved.WithLabelValues("admin").Inc()
+		// submitHam only bothers Akismet when it flagged this one
+		err = s.submitHam(conn, req.host, req.path, req.id)
+		if err != nil {
+			slog.Warn("Submitting ham to Akismet failed", "host", req.host, "path", req.path, "id", req.id, "err", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(moderationResult{
+		ID:       req.id,
+		Approved: true,
+		Changed:  added,
+	})
+}
+
+// approveComment adds a comment from the :all zset to the :approved zset,
+// keeping its score. It reports whether the comment wasn't approved before.
+// Newly approved comments go out to the streams of the page and into the
+// recent comments of the host and the replies of their parent, and with
+// TRUST_COMMENTERS=true, the author becomes a trusted commenter.
+func approveComment(conn redis.Conn, host, path string, id int64) (bool, error) {
+	score, err := redis.Int64(conn.Do("ZSCORE", fmt.Sprintf(keyAll, host, path), id))
+	if err == redis.ErrNil {
+		return false, errNoComment
+	}
+	if err != nil {
+		return false, err
+	}
+	added, err := redis.Bool(conn.Do("ZADD", fmt.Sprintf(keyApproved, host, path), "NX", score, id))
+	if err != nil || !added {
+		return added, err
+	}
+	publishApproved(conn, host, path, id)
+	publishEvent(conn, "approved", host, path, id)
+	if err = addRecent(conn, host, path, id, score); err != nil {
+		redisErrors.Inc()
+		slog.Error("Adding recent comment failed", "host", host, "path", path, "id", id, "err", err)
+	}
+	if err = addReply(conn, host, path, id, score); err != nil {
+		redisErrors.Inc()
+		slog.Error("Adding reply failed", "host", host, "path", path, "id", id, "err", err)
+	}
+	if !trustCommenters {
+		return added, nil
+	}
+	if err = trustCommenter(conn, host, path, id); err != nil {
+		// The comment is approved, just the author isn't trusted yet
+		redisErrors.Inc()
+		slog.Error("Trusting commenter failed", "host", host, "path", path, "id", id, "err", err)
+	}
+	return added, nil
+}
+
+func (s *Server) unapproveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := cleanModerationRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, req.host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	removed, err := unapproveComment(conn, req.host, req.path, req.id)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if removed {
+		slog.Info("Unapproved comment", "host", req.host, "path", req.path, "id", req.id)
+		commentsRejected.Inc()
+		err = s.submitSpam(conn, req.host, req.path, req.id)
+		if err != nil {
+			slog.Warn("Submitting spam to Akismet failed", "host", req.host, "path", req.path, "id", req.id, "err", err)
+			// Akismet just doesn't learn from this one, no real harm done
+		}
+	} else {
+		// Pending already, as long as it exists
+		_, err = redis.Int64(conn.Do("ZSCORE", fmt.Sprintf(keyAll, req.host, req.path), req.id))
+		if err == redis.ErrNil {
+			http.Error(w, errNoComment.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			backendError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(moderationResult{
+		ID:       req.id,
+		Approved: false,
+		Changed:  removed,
+	})
+}
+
+// isApproved reports whether a comment is in the :approved zset.
+func isApproved(conn redis.Conn, host, path string, id int64) (bool, error) {
+	_, err := redis.Int64(conn.Do("ZSCORE", fmt.Sprintf(keyApproved, host, path), id))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unapproveComment removes a comment from the :approved zset. The comment
+// stays in the :all zset, so it can be approved again later. It reports
+// whether the comment was approved before.
+func unapproveComment(conn redis.Conn, host, path string, id int64) (bool, error) {
+	removed, err := redis.Bool(conn.Do("ZREM", fmt.Sprintf(keyApproved, host, path), id))
+	if err != nil || !removed {
+		return removed, err
+	}
+	publishEvent(conn, "unapproved", host, path, id)
+	// Deleted comments stay in there, getRecent skips them
+	if err = removeRecent(conn, host, path, id); err != nil {
+		redisErrors.Inc()
+		slog.Error("Removing recent comment failed", "host", host, "path", path, "id", id, "err", err)
+	}
+	if err = removeReply(conn, host, path, id); err != nil {
+		redisErrors.Inc()
+		slog.Error("Removing reply failed", "host", host, "path", path, "id", id, "err", err)
+	}
+	return removed, nil
+}
+
+func (s *Server) pendingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := commentURL(r)
+	if err != nil {
+		http.Error(w, "bad URL", http.StatusBadRequest)
+		return
+	}
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, u.Host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	comments, hasMore, err := getPendingComments(conn, u.Host, u.Path, offset, limit)
+	if err == errBadOffset || err == errBadLimit {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Comments []fullComment `json:"comments"`
+		HasMore  bool          `json:"has_more"`
+	}{comments, hasMore})
+}
+
+// getPendingComments returns at most limit comments that are in the :all zset
+// but not in the :approved zset, oldest first, skipping the first offset. It
+// walks the :all zset maxLimit comments at a time, so it reads no further than
+// the comments it returns.
+func getPendingComments(conn redis.Conn, host, path string, offset, limit int) ([]fullComment, bool, error) {
+	limit, err := checkPage(offset, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	// One more than limit tells whether there are more
+	var pairs []string
+	for start := 0; len(pairs) <= 2*limit; start += maxLimit {
+		window, err := redis.Strings(conn.Do("ZRANGE", fmt.Sprintf(keyAll, host, path), start, start+maxLimit-1, "WITHSCORES"))
+		if err != nil {
+			return nil, false, err
+		}
+		if len(window) == 0 {
+			break
+		}
+		for i := 0; i < len(window); i += 2 {
+			conn.Send("ZSCORE", fmt.Sprintf(keyApproved, host, path), window[i])
+		}
+		if err = conn.Flush(); err != nil {
+			return nil, false, err
+		}
+		for i := 0; i < len(window); i += 2 {
+			score, err := conn.Receive()
+			if err != nil {
+				return nil, false, err
+			}
+			if score != nil {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			pairs = append(pairs, window[i], window[i+1])
+		}
+	}
+	hasMore := len(pairs) > 2*limit
+	if hasMore {
+		pairs = pairs[:2*limit]
+	}
+	comments, err := loadComments(conn, host, path, pairs)
+	if err != nil {
+		return nil, false, err
+	}
+	if parseUserAgents {
+		for i := range comments {
+			if err = describeUserAgent(conn, host, path, &comments[i]); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return comments, hasMore, nil
+}
+
+// pendingRetention is how long comments that aren't approved are kept for
+// moderation, before they're purged. Zero, the default, keeps them forever.
+var pendingRetention = envDuration("PENDING_RETENTION", 0)
+
+// purgePending deletes the comments posted more than pendingRetention before
+// now that aren't approved, and returns how many it deleted. Approved comments
+// are never touched.
+func purgePending(conn redis.Conn, now time.Time) (int, error) {
+	if pendingRetention <= 0 {
+		return 0, nil
+	}
+	// Scores in seconds sort before this anyway, and they're older
+	cutoff := now.Add(-pendingRetention).UnixMilli()
+	prefix := "{" + keyPrefix + "://"
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*}:all", "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return n, err
+		}
+		for _, key := range keys {
+			host, path := splitPage(strings.TrimSuffix(strings.TrimPrefix(key, prefix), "}:all"))
+			ids, err := redis.Int64s(conn.Do("ZRANGEBYSCORE", key, "-inf", cutoff))
+			if err != nil {
+				return n, err
+			}
+			for _, id := range ids {
+				approved, err := isApproved(conn, host, path, id)
+				if err != nil {
+					return n, err
+				}
+				if approved {
+					continue
+				}
+				if _, err = deleteComment(conn, host, path, id); err != nil {
+					return n, err
+				}
+				n++
+			}
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// purgePendingLoop runs purgePending every hour, for as long as the process
+// runs.
+func (s *Server) purgePendingLoop() {
+	if pendingRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		conn := s.pool.Get()
+		n, err := purgePending(conn, s.now())
+		conn.Close()
+		if err != nil {
+			redisErrors.Inc()
+			slog.Error("Purging pending comments failed", "purged", n, "err", err)
+		} else {
+			slog.Info("Purged pending comments", "purged", n)
+		}
+		<-ticker.C
+	}
+}
+
+// parseUserAgents adds the browser and OS to comments in the moderation
+// listing. They're parsed when a comment is listed for the first time, so
+// it costs nothing when commenting.
+var parseUserAgents = os.Getenv("PARSE_USER_AGENT") == "true"
+
+// describeUserAgent sets the browser and OS of c from its user agent, and
+// stores them with the comment for the next time.
+func describeUserAgent(conn redis.Conn, host, path string, c *fullComment) error {
+	if c.Browser != "" || c.UserAgent == "" {
+		return nil
+	}
+	ua := useragent.New(c.UserAgent)
+	name, version := ua.Browser()
+	c.Browser = strings.TrimSpace(name + " " + version)
+	if c.Browser == "" {
+		// Not empty, so it's not parsed again
+		c.Browser = "unknown"
+	}
+	if ua.Bot() {
+		c.Browser += " (bot)"
+	}
+	c.OS = ua.OS()
+	id, _ := strconv.ParseInt(c.ID, 10, 64)
+	_, err := conn.Do("HSET", fmt.Sprintf(keyComment, host, path, id),
+		"browser", c.Browser, "os", c.OS)
+	return err
+}
+
+func (s *Server) blockHandler(w http.ResponseWriter, r *http.Request) {
+	s.blockIPHandler(w, r, "SADD")
+}
+
+func (s *Server) unblockHandler(w http.ResponseWriter, r *http.Request) {
+	s.blockIPHandler(w, r, "SREM")
+}
+
+// blockIPHandler adds an IP address or CIDR range to the blocked IPs, or
+// removes it, depending on cmd.
+func (s *Server) blockIPHandler(w http.ResponseWriter, r *http.Request, cmd string) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ip, err := cleanBlockedIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	changed, err := redis.Bool(conn.Do(cmd, keyBlockedIPs, ip))
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if changed {
+		slog.Info("Changed blocked IPs", "cmd", cmd, "ip", ip)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		IP      string `json:"ip"`
+		Blocked bool   `json:"blocked"`
+		Changed bool   `json:"changed"`
+	}{ip, cmd == "SADD", changed})
+}
+
+func (s *Server) enableHandler(w http.ResponseWriter, r *http.Request) {
+	s.setEnabledHandler(w, r, true)
+}
+
+func (s *Server) disableHandler(w http.ResponseWriter, r *http.Request) {
+	s.setEnabledHandler(w, r, false)
+}
+
+// setEnabledHandler opens or closes comments on a page. Closing stores false
+// instead of removing the key, so auto_enable doesn't open it again.
+func (s *Server) setEnabledHandler(w http.ResponseWriter, r *http.Request, enabled bool) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := commentURL(r)
+	if err != nil || u.Host == "" {
+		http.Error(w, "bad url value", http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, u.Host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	_, err = conn.Do("SET", fmt.Sprintf(keyEnabled, u.Host, u.Path), enabled)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	slog.Info("Set enabled", "host", u.Host, "path", u.Path, "enabled", enabled)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		URL     string `json:"url"`
+		Enabled bool   `json:"enabled"`
+	}{u.String(), enabled})
+}
+
+// cleanHostname normalizes a hostname, optionally with a port, for the
+// keyAutoEnable set.
+func cleanHostname(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	hostname := s
+	if h, port, err := net.SplitHostPort(s); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", errors.New("bad host value")
+		}
+		hostname = h
+	}
+	if hostname == "" || len(hostname) > 253 {
+		return "", errors.New("bad host value")
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", errors.New("bad host value")
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return "", errors.New("bad host value")
+			}
+		}
+	}
+	return canonicalHost(s), nil
+}
+
+func (s *Server) autoEnableListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	hosts, err := redis.Strings(conn.Do("SMEMBERS", keyAutoEnable))
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	sort.Strings(hosts)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Hosts []string `json:"hosts"`
+	}{hosts})
+}
+
+func (s *Server) autoEnableAddHandler(w http.ResponseWriter, r *http.Request) {
+	s.autoEnableHandler(w, r, "SADD")
+}
+
+func (s *Server) autoEnableRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	s.autoEnableHandler(w, r, "SREM")
+}
+
+// autoEnableHandler adds a hostname to the auto_enable set, or removes it,
+// depending on cmd. Pages that were enabled already stay enabled.
+func (s *Server) autoEnableHandler(w http.ResponseWriter, r *http.Request, cmd string) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	host, err := cleanHostname(r.FormValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	changed, err := redis.Bool(conn.Do(cmd, keyAutoEnable, host))
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if changed {
+		slog.Info("Changed auto_enable", "cmd", cmd, "host", host)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Host        string `json:"host"`
+		AutoEnabled bool   `json:"auto_enabled"`
+		Changed     bool   `json:"changed"`
+	}{host, cmd == "SADD", changed})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// moderateTestComment runs a moderation action on a comment on
+// https://example.com/post with the admin token.
+func moderateTestComment(s *Server, action string, id int64) *httptest.ResponseRecorder {
+	return testRequest(s, "POST", "/comments/"+action, url.Values{
+		"url": {"https://example.com/post"},
+		"id":  {fmt.Sprint(id)},
+	}, http.Header{"Authorization": {"Bearer secret"}})
+}
+
+func TestUnapproveSubmitsSpam(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "secret"
+	s, _ := newTestServer(t)
+	submitted := fakeAkismet(t, s, "false")
+	conn := s.pool.Get()
+	approved := saveTestComment(t, conn, "Alice", "Hello", true)
+	pending := saveTestComment(t, conn, "Bob", "Hello", false)
+	conn.Close()
+
+	if w := moderateTestComment(s, "unapprove", 99); w.Code != http.StatusNotFound {
+		t.Errorf("unapprove of an unknown id status = %d, want 404", w.Code)
+	}
+	if w := moderateTestComment(s, "unapprove", pending); w.Code != http.StatusOK {
+		t.Errorf("unapprove of a pending comment status = %d, want 200", w.Code)
+	}
+	if got := submitted(); len(got) != 0 {
+		t.Errorf("submitted %v without unapproving anything", got)
+	}
+	if w := moderateTestComment(s, "unapprove", approved); w.Code != http.StatusOK {
+		t.Errorf("unapprove status = %d, want 200", w.Code)
+	}
+	if got := submitted(); len(got) != 1 || got[0] != akismetSubmitSpamPath {
+		t.Errorf("submitted %v, want one submit-spam", got)
+	}
+}
+
+func TestApproveSubmitsHam(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "secret"
+	tests := []struct {
+		name   string
+		result string
+		want   int
+	}{
+		{"never checked", "", 0},
+		{"held as ham", "ham", 0},
+		{"flagged as spam", "spam", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m := newTestServer(t)
+			submitted := fakeAkismet(t, s, "false")
+			conn := s.pool.Get()
+			id := saveTestComment(t, conn, "Alice", "Hello", false)
+			conn.Close()
+			if tt.result != "" {
+				m.HSet(fmt.Sprintf(keyComment, "example.com", "/post", id), "akismet_result", tt.result)
+			}
+			if w := moderateTestComment(s, "approve", id); w.Code != http.StatusOK {
+				t.Fatalf("approve status = %d, want 200", w.Code)
+			}
+			got := submitted()
+			if len(got) != tt.want {
+				t.Fatalf("submitted %v, want %d submit-ham", got, tt.want)
+			}
+			if tt.want > 0 && got[0] != akismetSubmitHamPath {
+				t.Errorf("submitted %v, want submit-ham", got)
+			}
+		})
+	}
+}
+
+func TestGetPendingCommentsPages(t *testing.T) {
+	s, _ := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	// Spread over more than one window of the :all zset
+	var pending []string
+	for i := 0; i < maxLimit+50; i++ {
+		// Distinct scores, so they're ordered by id
+		id, err := saveComment(context.Background(), conn, testComment("Alice", "Hello"), testNow.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("saveComment: %v", err)
+		}
+		if i%3 != 0 {
+			approveComment(conn, "example.com", "/post", id)
+		} else {
+			pending = append(pending, fmt.Sprint(id))
+		}
+	}
+	tests := []struct {
+		offset, limit int
+		more          bool
+	}{
+		{0, 10, true},
+		{0, len(pending), false},
+		{5, 20, true},
+		{len(pending) - 3, 10, false},
+		{len(pending), 10, false},
+	}
+	for _, tt := range tests {
+		comments, hasMore, err := getPendingComments(conn, "example.com", "/post", tt.offset, tt.limit)
+		if err != nil {
+			t.Fatalf("getPendingComments(%d, %d): %v", tt.offset, tt.limit, err)
+		}
+		want := pending[tt.offset:min(tt.offset+tt.limit, len(pending))]
+		var got []string
+		for _, c := range comments {
+			got = append(got, c.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) || hasMore != tt.more {
+			t.Errorf("getPendingComments(%d, %d) = %v, %t, want %v, %t", tt.offset, tt.limit, got, hasMore, want, tt.more)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// webhookURL gets a JSON POST for every new comment, when set.
+	webhookURL    = os.Getenv("WEBHOOK_URL")
+	webhookClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// commentEvent describes a newly submitted comment to the outside world, or
+// with Event set, something else that happened to a comment.
+type commentEvent struct {
+	Event     string `json:"event,omitempty"`
+	Host      string `json:"host"`
+	Path      string `json:"path"`
+	ID        int64  `json:"id"`
+	Author    string `json:"author"`
+	Approved  bool   `json:"approved"`
+	Permalink string `json:"permalink"`
+}
+
+// redisEvent is published on keyEvents when something happens to a comment.
+type redisEvent struct {
+	// Action is new, approved or unapproved
+	Action string `json:"action"`
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+	ID     int64  `json:"id"`
+}
+
+// publishEvent publishes action on a comment on keyEvents, for other systems
+// to subscribe to. Failing that doesn't undo the action, so it's just logged.
+func publishEvent(conn redis.Conn, action, host, path string, id int64) {
+	msg, err := json.Marshal(redisEvent{Action: action, Host: host, Path: path, ID: id})
+	if err == nil {
+		_, err = conn.Do("PUBLISH", keyEvents, msg)
+	}
+	if err != nil {
+		redisErrors.Inc()
+		slog.Error("Publishing event failed", "action", action, "host", host, "path", path, "id", id, "err", err)
+	}
+}
+
+// sendWebhook posts event to webhookURL, retrying a couple of times. It
+// blocks, so call it in its own goroutine.
+func sendWebhook(event commentEvent) {
+	if webhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Encoding webhook failed", "host", event.Host, "path", event.Path, "id", event.ID, "err", err)
+		return
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		err = postWebhook(body)
+		if err == nil {
+			return
+		}
+	}
+	slog.Warn("Webhook failed", "host", event.Host, "path", event.Path, "id", event.ID, "err", err)
+}
+
+func postWebhook(body []byte) error {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+var (
+	// Email notifications are sent when both smtpHost and smtpTo are set.
+	// smtpUser and smtpPass are optional, for servers that need AUTH.
+	smtpHost = os.Getenv("SMTP_HOST")
+	smtpPort = envString("SMTP_PORT", "587")
+	smtpUser = os.Getenv("SMTP_USER")
+	smtpPass = os.Getenv("SMTP_PASS")
+	smtpFrom = os.Getenv("SMTP_FROM")
+	smtpTo   = os.Getenv("SMTP_TO")
+)
+
+// sendEmail notifies the admin of a new comment by email. It blocks, so call
+// it in its own goroutine.
+func sendEmail(req *commentSubmitRequest, id int64, approved bool) {
+	if smtpHost == "" || smtpTo == "" {
+		return
+	}
+	status := "It's held for moderation."
+	if approved {
+		status = "It was approved automatically."
+	}
+	subject := fmt.Sprintf("New comment by %s on %s%s", req.Author, req.host, req.path)
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s wrote a new comment (%d) on %s\r\n\r\n", req.Author, id, req.Permalink)
+	fmt.Fprintf(&body, "%s\r\n\r\n", req.Content)
+	fmt.Fprintf(&body, "%s\r\n", status)
+	if err := mailAdmin(subject, body.String()); err != nil {
+		slog.Warn("Email failed", "host", req.host, "path", req.path, "id", id, "err", err)
+	}
+}
+
+// mailAdmin sends an email to smtpTo, with body in CRLF line endings. Call it
+// only when email notifications are set up.
+func mailAdmin(subject, body string) error {
+	from := smtpFrom
+	if from == "" {
+		from = smtpTo
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", smtpTo)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	msg.WriteString(body)
+	var auth smtp.Auth
+	if smtpUser != "" {
+		auth = smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
+	}
+	return smtp.SendMail(net.JoinHostPort(smtpHost, smtpPort), auth, from,
+		[]string{smtpTo}, msg.Bytes())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// previewLimit is the number of previews allowed per IP in every
+	// previewWindow, zero disables rate limiting previews.
+	previewLimit  = envInt("PREVIEW_LIMIT", 60)
+	previewWindow = envDuration("PREVIEW_WINDOW", time.Minute)
+)
+
+// previewHandler renders comment_content the way it would show up once
+// posted, without saving anything.
+func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		s.preflight(w, r, "POST")
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := parseBody(w, r)
+	if err == errTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err = parseJSONForm(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	content, err := cleanPreviewContent(r.FormValue("comment_content"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	cors, err := corsOrigin(conn, r)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if cors == "" && r.Header.Get("Origin") != "" {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	setCORS(w, cors)
+	limited, retry, err := overLimit(conn, fmt.Sprintf(keyPreviewLimit, ip), previewLimit, previewWindow)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if limited {
+		// Round up, so clients don't retry a moment too early
+		w.Header().Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+		http.Error(w, "too many previews, try again later", http.StatusTooManyRequests)
+		return
+	}
+	// Showing what will be posted
+	content, err = cleanProfanity(conn, content)
+	if err == errProfanity {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Content string `json:"content"`
+	}{renderContent(content)})
+}
+
+// cleanPreviewContent checks content against the same limits as
+// cleanCommentSubmitRequest, so what previews fine can be posted too.
+func cleanPreviewContent(content string) (string, error) {
+	if content == "" {
+		return "", errors.New("bad comment_content value")
+	}
+	if utf8.RuneCountInString(content) > maxContentLength {
+		return "", errors.New("comment_content too long")
+	}
+	if maxLinks > 0 && maxLinksAction != "hold" && countLinks(content) > maxLinks {
+		return "", errTooManyLinks
+	}
+	return content, nil
+}
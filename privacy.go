@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// indexEmail adds a comment to the comments of email on host, if any.
+func indexEmail(conn redis.Conn, host, path string, id int64, email string) error {
+	if email == "" {
+		return nil
+	}
+	_, err := conn.Do("SADD", fmt.Sprintf(keyEmail, host, strings.ToLower(email)),
+		fmt.Sprintf("%d %s", id, path))
+	return err
+}
+
+// emailComments returns the paths and ids of the comments of email on host.
+func emailComments(conn redis.Conn, host, email string) (paths []string, ids []int64, err error) {
+	members, err := redis.Strings(conn.Do("SMEMBERS",
+		fmt.Sprintf(keyEmail, host, strings.ToLower(email))))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, member := range members {
+		rawID, path, _ := strings.Cut(member, " ")
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, path)
+		ids = append(ids, id)
+	}
+	return paths, ids, nil
+}
+
+// splitPage splits the host and path of a page, as it's in its keys.
+func splitPage(page string) (host, path string) {
+	if i := strings.Index(page, "/"); i >= 0 {
+		return page[:i], page[i:]
+	}
+	return page, ""
+}
+
+// indexEmails adds every stored comment to the email index, and returns how
+// many comments with an email it found.
+func indexEmails(conn redis.Conn) (int, error) {
+	prefix := "{" + keyPrefix + "://"
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*}:comment:*", "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return n, err
+		}
+		for _, key := range keys {
+			page, rawID, ok := strings.Cut(strings.TrimPrefix(key, prefix), "}:comment:")
+			id, err := strconv.ParseInt(rawID, 10, 64)
+			if !ok || err != nil {
+				continue
+			}
+			host, path := splitPage(page)
+			email, err := commentEmail(conn, host, path, id)
+			if err != nil {
+				return n, err
+			}
+			if email == "" {
+				continue
+			}
+			if err = indexEmail(conn, host, path, id, email); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// cleanEmail checks the email parameter of a data request.
+func cleanEmail(r *http.Request) (string, error) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errors.New("bad email value")
+	}
+	return strings.ToLower(email), nil
+}
+
+// exportHandler returns all comments of an email address on a host, for
+// subject access requests.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, err := cleanHostname(r.FormValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := cleanEmail(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	comments, err := exportComments(conn, host, email)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(comments)
+}
+
+// exportComments loads the comments of email on host, approved or not.
+func exportComments(conn redis.Conn, host, email string) ([]fullComment, error) {
+	paths, ids, err := emailComments(conn, host, email)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]fullComment, 0, len(ids)) // empty list, instead of nil
+	for i, id := range ids {
+		score, err := redis.String(conn.Do("ZSCORE", fmt.Sprintf(keyAll, host, paths[i]), id))
+		if err == redis.ErrNil {
+			// Deleted since
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		loaded, err := loadComments(conn, host, paths[i], []string{strconv.FormatInt(id, 10), score})
+		if err != nil {
+			return nil, err
+		}
+		loaded[0].Approved, err = isApproved(conn, host, paths[i], id)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, loaded...)
+	}
+	return comments, nil
+}
+
+// forgetHandler deletes all comments of an email address on a host, and
+// everything else stored about the address.
+func (s *Server) forgetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, err := cleanHostname(r.FormValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := cleanEmail(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	deleted, err := forgetEmail(conn, host, email)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	slog.Info("Forgot an email", "host", host, "deleted", deleted)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Deleted int `json:"deleted"`
+	}{deleted})
+}
+
+// forgetEmail deletes the comments of email on host, and removes email from
+// the email index and the trusted commenters. It returns the number of
+// comments deleted.
+func forgetEmail(conn redis.Conn, host, email string) (int, error) {
+	paths, ids, err := emailComments(conn, host, email)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for i, id := range ids {
+		existed, err := deleteComment(conn, host, paths[i], id)
+		if err != nil {
+			return deleted, err
+		}
+		if existed {
+			deleted++
+		}
+	}
+	// Only now, so a retry after an error finds the comments that are left
+	conn.Send("SREM", fmt.Sprintf(keyTrusted, host), email)
+	_, err = conn.Do("DEL", fmt.Sprintf(keyEmail, host, email))
+	return deleted, err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// defaultQuota is the number of comments a host can store, unless it has a
+// quota of its own in the keyQuotas hash. Zero means no limit.
+var defaultQuota = envInt("QUOTA", 0)
+
+// errOverQuota means a host stores as many comments as its quota allows.
+var errOverQuota = errors.New("comment quota of this site exceeded")
+
+// hostQuota returns the quota of host, zero meaning no limit.
+func hostQuota(conn redis.Conn, host string) (int, error) {
+	quota, err := redis.Int(conn.Do("HGET", keyQuotas, host))
+	if err == redis.ErrNil {
+		return defaultQuota, nil
+	}
+	return quota, err
+}
+
+// checkQuota returns errOverQuota when host can't store another comment.
+func checkQuota(conn redis.Conn, host string) error {
+	quota, err := hostQuota(conn, host)
+	if err != nil || quota <= 0 {
+		return err
+	}
+	stored, err := redis.Int(conn.Do("GET", fmt.Sprintf(keyHostCount, host)))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if stored >= quota {
+		return errOverQuota
+	}
+	return nil
+}
+
+// countComment adds delta to the number of comments stored for host. It's
+// only logged when that fails, the comment itself is stored or deleted fine.
+func countComment(conn redis.Conn, host string, delta int) {
+	if _, err := conn.Do("INCRBY", fmt.Sprintf(keyHostCount, host), delta); err != nil {
+		redisErrors.Inc()
+		slog.Error("Counting comments failed", "host", host, "delta", delta, "err", err)
+	}
+}
+
+// recountComments recounts the comments stored for every host, trash included,
+// and returns the number of hosts.
+func recountComments(conn redis.Conn) (int, error) {
+	prefix := "{" + keyPrefix + "://"
+	counts := make(map[string]int)
+	for _, suffix := range []string{"}:all", "}:trash"} {
+		cursor := "0"
+		for {
+			reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*"+suffix, "COUNT", 1000))
+			if err != nil {
+				return 0, err
+			}
+			var keys []string
+			if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+				return 0, err
+			}
+			for _, key := range keys {
+				host, _ := splitPage(strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix))
+				n, err := redis.Int(conn.Do("ZCARD", key))
+				if err != nil {
+					return 0, err
+				}
+				counts[host] += n
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	for host, n := range counts {
+		if _, err := conn.Do("SET", fmt.Sprintf(keyHostCount, host), n); err != nil {
+			return 0, err
+		}
+	}
+	return len(counts), nil
+}
+
+// quotaHandler shows the quota of a host and how much of it is used, and sets
+// it on POST. An empty quota resets it to the default.
+func (s *Server) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	host, err := cleanHostname(r.FormValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if r.Method == "POST" {
+		if v := r.FormValue("quota"); v == "" {
+			_, err = conn.Do("HDEL", keyQuotas, host)
+		} else {
+			quota, perr := strconv.Atoi(v)
+			if perr != nil || quota < 0 {
+				http.Error(w, "bad quota value", http.StatusBadRequest)
+				return
+			}
+			_, err = conn.Do("HSET", keyQuotas, host, quota)
+		}
+		if err != nil {
+			backendError(w, err)
+			return
+		}
+		slog.Info("Set quota", "host", host, "quota", r.FormValue("quota"))
+	}
+	quota, err := hostQuota(conn, host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	stored, err := redis.Int(conn.Do("GET", fmt.Sprintf(keyHostCount, host)))
+	if err != nil && err != redis.ErrNil {
+		backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Host   string `json:"host"`
+		Quota  int    `json:"quota"`
+		Stored int    `json:"stored"`
+	}{host, quota, stored})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// maxRecent is the number of comments kept in the recent comments of a host
+var maxRecent = envInt("MAX_RECENT", maxLimit)
+
+// recentComment is a comment in the recent comments of a host, with what it
+// takes to link to it.
+type recentComment struct {
+	comment
+	Path      string `json:"path"`
+	Permalink string `json:"permalink"`
+	// Link is the permalink with the comment's anchor
+	Link string `json:"link"`
+}
+
+// addRecent adds an approved comment to the recent comments of its host,
+// dropping the oldest when there are more than maxRecent.
+func addRecent(conn redis.Conn, host, path string, id, score int64) error {
+	key := fmt.Sprintf(keyRecent, host)
+	conn.Send("ZADD", key, score, fmt.Sprintf("%d %s", id, path))
+	_, err := conn.Do("ZREMRANGEBYRANK", key, 0, -maxRecent-1)
+	return err
+}
+
+// removeRecent removes a comment from the recent comments of its host.
+func removeRecent(conn redis.Conn, host, path string, id int64) error {
+	_, err := conn.Do("ZREM", fmt.Sprintf(keyRecent, host), fmt.Sprintf("%d %s", id, path))
+	return err
+}
+
+// getRecent returns the newest limit approved comments on host. Comments
+// that were deleted after their approval are left out.
+func getRecent(conn redis.Conn, host string, limit int) ([]recentComment, error) {
+	members, err := redis.Strings(conn.Do("ZREVRANGE", fmt.Sprintf(keyRecent, host), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]recentComment, 0) // empty list, instead of nil
+	for _, member := range members {
+		rawID, path, _ := strings.Cut(member, " ")
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			continue
+		}
+		c, err := approvedComment(conn, host, path, id)
+		if err == errNoComment {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, recentComment{
+			comment:   c.comment,
+			Path:      path,
+			Permalink: c.Permalink,
+			Link:      c.Permalink + "#" + anchorPrefix + rawID,
+		})
+	}
+	return comments, nil
+}
+
+func (s *Server) recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, err := cleanHostname(r.FormValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultLimit
+	if v := r.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, errBadLimit.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxRecent {
+		limit = maxRecent
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	cors, err := corsOrigin(conn, r)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	comments, err := getRecent(conn, host, limit)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setCORS(w, cors)
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Comments []recentComment `json:"comments"`
+	}{comments})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// sanitizer is the HTML policy for everything commenters submit, picked with
+// SANITIZER_POLICY: "ugc" (the default) allows the formatting and links that
+// Markdown produces, "strict" strips all HTML. Both strip everything that
+// could run scripts or otherwise take over the page.
+var sanitizer = sanitizerPolicy(envString("SANITIZER_POLICY", "ugc"))
+
+func sanitizerPolicy(name string) *bluemonday.Policy {
+	switch name {
+	case "ugc":
+		return bluemonday.UGCPolicy()
+	case "strict":
+		return bluemonday.StrictPolicy()
+	}
+	fatal("bad SANITIZER_POLICY value, expecting ugc or strict", "value", name)
+	return nil
+}
+
+// sanitize makes submitted text safe to use as HTML.
+func sanitize(s string) string {
+	return sanitizer.Sanitize(s)
+}
+
+// renderContent converts the raw Markdown of a stored comment to sanitized
+// HTML.
+func renderContent(content string) string {
+	unsafe := blackfriday.MarkdownCommon([]byte(content))
+	return addLinkRel(string(sanitizer.SanitizeBytes(unsafe)))
+}
+
+// linkRel is the rel attribute of links commenters submit, which tells search
+// engines not to reward them.
+var linkRel = envString("LINK_REL", "nofollow ugc")
+
+// addLinkRel sets the rel attribute of every link in sanitized HTML to
+// linkRel.
+func addLinkRel(s string) string {
+	if !strings.Contains(s, "<a") {
+		return s
+	}
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		if z.Next() == html.ErrorToken {
+			// io.EOF, reading from a string can't fail otherwise
+			return b.String()
+		}
+		t := z.Token()
+		if t.Type == html.StartTagToken && t.DataAtom == atom.A {
+			attrs := t.Attr[:0]
+			for _, attr := range t.Attr {
+				if attr.Key != "rel" {
+					attrs = append(attrs, attr)
+				}
+			}
+			t.Attr = append(attrs, html.Attribute{Key: "rel", Val: linkRel})
+		}
+		b.WriteString(t.String())
+	}
+}
+
+// authorLink returns the sanitized author name, linked to their URL if they
+// left one. The link goes through the sanitizer too, as older comments have
+// unchecked URLs.
+func authorLink(author, authorURL string) string {
+	if authorURL == "" {
+		return author
+	}
+	return addLinkRel(sanitize(fmt.Sprintf(`<a href="%s">%s</a>`,
+		html.EscapeString(authorURL), author)))
+}
+
+// countLinks returns the number of links in the raw Markdown of a comment,
+// counting bare URLs, Markdown links and HTML links alike.
+func countLinks(content string) int {
+	html := strings.ToLower(string(blackfriday.MarkdownCommon([]byte(content))))
+	n := strings.Count(html, "<a ")
+	// Markdown only links URLs with a scheme, so count www.example.com too
+	n += len(bareWWW.FindAllString(anchor.ReplaceAllString(html, ""), -1))
+	return n
+}
+
+var (
+	anchor  = regexp.MustCompile(`(?s)<a\s.*?</a>`)
+	bareWWW = regexp.MustCompile(`(^|[^\w./])www\.[\w-]+\.`)
+)
+
+// gravatarDefault is the image Gravatar shows for commenters without one,
+// like "identicon" or "mp".
+var gravatarDefault = envString("GRAVATAR_DEFAULT", "identicon")
+
+// gravatarURL returns the Gravatar image URL for email. Only the hash of the
+// email ends up in the URL.
+func gravatarURL(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	query := url.Values{"d": {gravatarDefault}}
+	if email == "" {
+		// Nothing to look up, always use the default image
+		query.Set("f", "y")
+	}
+	return fmt.Sprintf("https://www.gravatar.com/avatar/%x?%s",
+		md5.Sum([]byte(email)), query.Encode())
+}
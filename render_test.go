@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestRenderContentXSS(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"script", "<script>alert(1)</script>hi", "<p>hi</p>\n"},
+		{"markdown javascript link", "[x](javascript:alert(1))", "<p>x</p>\n"},
+		{"markdown javascript link cased", "[x](JaVaScRiPt:alert(1))", "<p>x</p>\n"},
+		{"html javascript link", `<a href="javascript:alert(1)">x</a>`, "<p>x</p>\n"},
+		{"onerror", "<img src=x onerror=alert(1)>", "<p><img src=\"x\"></p>\n"},
+		{"onload", "<svg onload=alert(1)>", "<p></p>\n"},
+		{"iframe", "<iframe src=//evil.example></iframe>", "\n"},
+		{"raw html in markdown", "**bold** <b onclick=alert(1)>b</b>", "<p><strong>bold</strong> <b>b</b></p>\n"},
+		{"raw html block", "# Title\n\n<div style=\"background:url(x)\">raw</div>", "<h1>Title</h1>\n\n<div>raw</div>\n"},
+		{"safe link", `<a href="https://ok.example">ok</a>`, "<p><a href=\"https://ok.example\" rel=\"nofollow ugc\">ok</a></p>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderContent(tt.content); got != tt.want {
+				t.Errorf("renderContent(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorLinkXSS(t *testing.T) {
+	tests := []struct {
+		name, author, authorURL, want string
+	}{
+		{"script in name", "<script>alert(1)</script>Bob", "", "Bob"},
+		{"onmouseover in name", "<b onmouseover=alert(1)>Bob</b>", "", "<b>Bob</b>"},
+		{"javascript url", "Bob", "javascript:alert(1)", "Bob"},
+		{"attribute breakout", "Bob", `https://bob.example/"onmouseover="alert(1)`,
+			"<a href=\"https://bob.example/%22onmouseover=%22alert%281%29\" rel=\"nofollow ugc\">Bob</a>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Like loadComments does it
+			if got := authorLink(sanitize(tt.author), tt.authorURL); got != tt.want {
+				t.Errorf("authorLink(%q, %q) = %q, want %q", tt.author, tt.authorURL, got, tt.want)
+			}
+		})
+	}
+}
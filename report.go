@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// reportThreshold is the number of readers that have to report a comment
+	// before it's unapproved, zero never unapproves reported comments.
+	reportThreshold = envInt("REPORT_THRESHOLD", 3)
+
+	// reportLimit is the number of reports allowed per IP in every
+	// reportWindow, zero disables rate limiting reports.
+	reportLimit  = envInt("REPORT_LIMIT", 10)
+	reportWindow = envDuration("REPORT_WINDOW", time.Hour)
+)
+
+// heldReported is the held_reason of comments unapproved after too many
+// reports.
+const heldReported = "reported"
+
+func (s *Server) reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		s.preflight(w, r, "POST")
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := parseBody(w, r)
+	if err == errTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		return
+	}
+	req, err := cleanModerationRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	cors, err := corsOrigin(conn, r)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if cors == "" && r.Header.Get("Origin") != "" {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	// Whatever happens to the report, the reader gets the same answer, so
+	// it can't be used to find out about comments or the threshold
+	limited, _, err := overLimit(conn, fmt.Sprintf(keyReportLimit, ip), reportLimit, reportWindow)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !limited {
+		err = reportComment(conn, req.host, req.path, req.id, ip)
+		if err != nil {
+			backendError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setCORS(w, cors)
+	w.WriteHeader(http.StatusAccepted)
+	e := json.NewEncoder(w)
+	e.Encode(struct {
+		Status string `json:"status"`
+	}{"received"})
+}
+
+// reportComment counts a report of an approved comment, once for every
+// reporting IP. When the count reaches reportThreshold, the comment is
+// unapproved and held for moderation, and the admin gets notified.
+func reportComment(conn redis.Conn, host, path string, id int64, ip string) error {
+	_, err := redis.Int64(conn.Do("ZSCORE", fmt.Sprintf(keyApproved, host, path), id))
+	if err == redis.ErrNil {
+		// Not approved (anymore), or no such comment
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	added, err := redis.Bool(conn.Do("SADD", fmt.Sprintf(keyReporters, host, path, id), sign("report", ip)))
+	if err != nil || !added {
+		return err
+	}
+	reports, err := redis.Int(conn.Do("HINCRBY", fmt.Sprintf(keyComment, host, path, id), "reports", 1))
+	if err != nil {
+		return err
+	}
+	slog.Info("Reported comment", "host", host, "path", path, "id", id, "ip", ip, "reports", reports)
+	if reportThreshold <= 0 || reports != reportThreshold {
+		return nil
+	}
+	removed, err := unapproveComment(conn, host, path, id)
+	if err != nil || !removed {
+		return err
+	}
+	slog.Info("Unapproved comment", "host", host, "path", path, "id", id, "outcome", heldReported)
+	if err = holdComment(conn, host, path, id, heldReported); err != nil {
+		return err
+	}
+	values, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf(keyComment, host, path, id)))
+	if err != nil {
+		// The comment is unapproved, just nobody hears about it
+		slog.Error("Loading reported comment failed", "host", host, "path", path, "id", id, "err", err)
+		return nil
+	}
+	go notifyReported(host, path, id, values, reports)
+	return nil
+}
+
+// notifyReported sends out the webhook and email notifications about a
+// comment unapproved after reports.
+func notifyReported(host, path string, id int64, values map[string]string, reports int) {
+	sendWebhook(commentEvent{
+		Event:     heldReported,
+		Host:      host,
+		Path:      path,
+		ID:        id,
+		Author:    values["comment_author"],
+		Permalink: values["permalink"],
+	})
+	if smtpHost == "" || smtpTo == "" {
+		return
+	}
+	subject := fmt.Sprintf("Comment by %s on %s%s reported", values["comment_author"], host, path)
+	body := fmt.Sprintf("%s's comment (%d) on %s was reported %d times, and is held for moderation now.\r\n\r\n%s\r\n",
+		values["comment_author"], id, values["permalink"], reports, values["comment_content"])
+	if err := mailAdmin(subject, body); err != nil {
+		slog.Warn("Email failed", "host", host, "path", path, "id", id, "err", err)
+	}
+}
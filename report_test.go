@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestReportForgedForwardedFor(t *testing.T) {
+	s, m := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	id := saveTestComment(t, conn, "Alice", "Hello", true)
+	for i := 0; i < reportThreshold; i++ {
+		w := testRequest(s, "POST", "/comments/report", url.Values{
+			"url": {"https://example.com/post"},
+			"id":  {fmt.Sprint(id)},
+		}, http.Header{"X-Forwarded-For": {fmt.Sprintf("203.0.113.%d", i+1)}})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("report status = %d, want 202", w.Code)
+		}
+	}
+	// All from the same address, so just one report
+	if got := m.HGet(fmt.Sprintf(keyComment, "example.com", "/post", id), "reports"); got != "1" {
+		t.Errorf("reports = %q, want 1", got)
+	}
+	if approved, _ := isApproved(conn, "example.com", "/post", id); !approved {
+		t.Error("comment unapproved by reports from one address")
+	}
+}
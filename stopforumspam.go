@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// stopForumSpamConfidence is the confidence score, from 0 to 100, from
+	// which StopForumSpam flags a commenter's IP address or email.
+	stopForumSpamConfidence = envInt("STOPFORUMSPAM_CONFIDENCE", 50)
+	// stopForumSpamTimeout is how long a lookup gets, so it doesn't hold up
+	// the Akismet check it runs alongside.
+	stopForumSpamTimeout = envDuration("STOPFORUMSPAM_TIMEOUT", 2*time.Second)
+	// stopForumSpamCache is how long commenters that aren't flagged aren't
+	// looked up again.
+	stopForumSpamCache = envDuration("STOPFORUMSPAM_CACHE", time.Hour)
+)
+
+// heldStopForumSpam is the held_reason of comments that Akismet let through,
+// but StopForumSpam flagged.
+const heldStopForumSpam = "stopforumspam"
+
+// stopForumSpamAnswer is the part of a StopForumSpam API answer that's used.
+type stopForumSpamAnswer struct {
+	Success int                      `json:"success"`
+	Error   string                   `json:"error"`
+	IP      stopForumSpamAppearances `json:"ip"`
+	Email   stopForumSpamAppearances `json:"email"`
+}
+
+type stopForumSpamAppearances struct {
+	Appears    int     `json:"appears"`
+	Confidence float64 `json:"confidence"`
+}
+
+// lookupStopForumSpam starts looking up the commenter of a stored comment at
+// StopForumSpam, and returns a function waiting for whether they're flagged.
+// Lookup failures count as not flagged, because Akismet has the final say.
+// The function takes the connection, which can't be used by both at once.
+func (s *Server) lookupStopForumSpam(ctx context.Context, conn redis.Conn, host, path string, id int64, ip string) func(redis.Conn) bool {
+	notFlagged := func(redis.Conn) bool { return false }
+	if s.stopForumSpamURL == "" {
+		return notFlagged
+	}
+	email, err := commentEmail(conn, host, path, id)
+	if err != nil {
+		redisErrors.Inc()
+		slog.Error("Loading email for StopForumSpam failed", "host", host, "path", path, "id", id, "err", err)
+		return notFlagged
+	}
+	cacheKey := fmt.Sprintf(keyStopForumSpam, sign("stopforumspam", ip, email))
+	cached, err := redis.Bool(conn.Do("EXISTS", cacheKey))
+	if err != nil {
+		redisErrors.Inc()
+		slog.Error("Checking StopForumSpam cache failed", "err", err)
+	}
+	if cached {
+		stopForumSpamChecks.WithLabelValues("cached").Inc()
+		return notFlagged
+	}
+	type result struct {
+		flagged bool
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		flagged, err := s.stopForumSpamCheck(ctx, ip, email)
+		done <- result{flagged, err}
+	}()
+	return func(conn redis.Conn) bool {
+		res := <-done
+		if res.err != nil {
+			stopForumSpamChecks.WithLabelValues("error").Inc()
+			slog.Warn("Looking up commenter at StopForumSpam failed", "host", host, "path", path, "id", id, "err", res.err)
+			return false
+		}
+		if res.flagged {
+			stopForumSpamChecks.WithLabelValues("spam").Inc()
+			return true
+		}
+		stopForumSpamChecks.WithLabelValues("ham").Inc()
+		_, err := conn.Do("SET", cacheKey, 1, "PX", int64(stopForumSpamCache/time.Millisecond))
+		if err != nil {
+			redisErrors.Inc()
+			slog.Error("Caching StopForumSpam result failed", "err", err)
+		}
+		return false
+	}
+}
+
+// stopForumSpamCheck asks StopForumSpam whether ip or email is known for spam
+// with at least stopForumSpamConfidence.
+func (s *Server) stopForumSpamCheck(ctx context.Context, ip, email string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, stopForumSpamTimeout)
+	defer cancel()
+	query := url.Values{"json": []string{""}, "ip": []string{ip}}
+	if email != "" {
+		query.Set("email", email)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.stopForumSpamURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status from stopforumspam: %s", resp.Status)
+	}
+	var answer stopForumSpamAnswer
+	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return false, err
+	}
+	if answer.Success != 1 {
+		return false, fmt.Errorf("stopforumspam says: %q", answer.Error)
+	}
+	confidence := float64(stopForumSpamConfidence)
+	return answer.IP.Appears > 0 && answer.IP.Confidence >= confidence ||
+		answer.Email.Appears > 0 && answer.Email.Confidence >= confidence, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// streamKeepalive is how often streams get a comment line, so proxies don't
+// close them for being idle.
+var streamKeepalive = envDuration("STREAM_KEEPALIVE", 30*time.Second)
+
+// approvedEvent is published on keyStream for every approved comment.
+type approvedEvent struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+	ID   int64  `json:"id"`
+}
+
+// publishApproved tells the streams of a page about an approved comment.
+// Failing that only leaves the streams behind, so it's just logged.
+func publishApproved(conn redis.Conn, host, path string, id int64) {
+	msg, err := json.Marshal(approvedEvent{Host: host, Path: path, ID: id})
+	if err == nil {
+		_, err = conn.Do("PUBLISH", keyStream, msg)
+	}
+	if err != nil {
+		redisErrors.Inc()
+		slog.Error("Publishing approved comment failed", "host", host, "path", path, "id", id, "err", err)
+	}
+}
+
+// streamHub fans out the approved comments published on keyStream to the
+// streams of their page. One Redis subscription serves all streams.
+type streamHub struct {
+	mu     sync.Mutex
+	pages  map[string]map[chan int64]struct{}
+	closed chan struct{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		pages:  make(map[string]map[chan int64]struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// subscribe returns a channel getting the ids of comments approved on page.
+func (h *streamHub) subscribe(page string) chan int64 {
+	ch := make(chan int64, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pages[page] == nil {
+		h.pages[page] = make(map[chan int64]struct{})
+	}
+	h.pages[page][ch] = struct{}{}
+	return ch
+}
+
+func (h *streamHub) unsubscribe(page string, ch chan int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.pages[page], ch)
+	if len(h.pages[page]) == 0 {
+		delete(h.pages, page)
+	}
+}
+
+// send passes id on to the streams of page, skipping streams that are too
+// far behind to keep up.
+func (h *streamHub) send(page string, id int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.pages[page] {
+		select {
+		case ch <- id:
+		default:
+		}
+	}
+}
+
+// close ends all streams, so shutting down doesn't wait for them.
+func (h *streamHub) close() {
+	close(h.closed)
+}
+
+// listenStream subscribes to keyStream and passes the events on to the
+// streamHub. It reconnects when the connection breaks, and returns only when
+// the hub is closed.
+func (s *Server) listenStream() {
+	for {
+		err := s.receiveStream()
+		select {
+		case <-s.streams.closed:
+			return
+		default:
+		}
+		redisErrors.Inc()
+		slog.Error("Receiving approved comments failed", "err", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *Server) receiveStream() error {
+	psc := redis.PubSubConn{Conn: s.pool.Get()}
+	defer psc.Close()
+	if err := psc.Subscribe(keyStream); err != nil {
+		return err
+	}
+	// Ping now and then, so a dead connection doesn't go unnoticed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(streamKeepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if psc.Ping("") != nil {
+					return
+				}
+			case <-s.streams.closed:
+				psc.Unsubscribe()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * streamKeepalive).(type) {
+		case error:
+			return v
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case redis.Message:
+			var event approvedEvent
+			if err := json.Unmarshal(v.Data, &event); err != nil {
+				slog.Warn("Bad approved comment event", "event", string(v.Data), "err", err)
+				continue
+			}
+			s.streams.send(event.Host+event.Path, event.ID)
+		}
+	}
+}
+
+// streamHandler sends the comments approved on a page as server-sent events,
+// for as long as the client stays.
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := commentURL(r)
+	if err != nil {
+		http.Error(w, "bad URL", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	// Not holding on to a connection while waiting
+	conn := s.pool.Get()
+	cors, err := corsOrigin(conn, r)
+	conn.Close()
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	ch := s.streams.subscribe(u.Host + u.Path)
+	defer s.streams.unsubscribe(u.Host+u.Path, ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Or nginx holds back the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	setCORS(w, cors)
+	fmt.Fprintf(w, "retry: %d\n\n", 5000)
+	flusher.Flush()
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.streams.closed:
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case id := <-ch:
+			conn := s.pool.Get()
+			c, err := approvedComment(conn, u.Host, u.Path, id)
+			conn.Close()
+			if err == errNoComment {
+				// Unapproved again already
+				continue
+			}
+			if err != nil {
+				redisErrors.Inc()
+				slog.Error("Loading streamed comment failed", "host", u.Host, "path", u.Path, "id", id, "err", err)
+				continue
+			}
+			data, err := json.Marshal(c.comment)
+			if err != nil {
+				slog.Error("Encoding streamed comment failed", "host", u.Host, "path", u.Path, "id", id, "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: comment\ndata: %s\n\n", id, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// approvedComment loads a single approved comment.
+func approvedComment(conn redis.Conn, host, path string, id int64) (*fullComment, error) {
+	score, err := redis.String(conn.Do("ZSCORE", fmt.Sprintf(keyApproved, host, path), id))
+	if err == redis.ErrNil {
+		return nil, errNoComment
+	}
+	if err != nil {
+		return nil, err
+	}
+	full, err := loadComments(conn, host, path, []string{strconv.FormatInt(id, 10), score})
+	if err != nil {
+		return nil, err
+	}
+	return &full[0], nil
+}
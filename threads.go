@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// threadComment is a comment with the number of approved direct replies to
+// it, and the first of them when they're asked for.
+type threadComment struct {
+	comment
+	ReplyCount int             `json:"reply_count"`
+	Replies    []threadComment `json:"replies,omitempty"`
+}
+
+// threadList is the envelope around a page of threads, like commentList.
+type threadList struct {
+	Comments []threadComment `json:"comments"`
+	HasMore  bool            `json:"has_more"`
+	Enabled  bool            `json:"enabled"`
+}
+
+var errBadReplies = errors.New("bad replies value")
+
+// repliesParam reads the optional replies parameter from r, the number of
+// replies to include with every top-level comment. It's -1 without the
+// parameter, for the flat list of all comments.
+func repliesParam(r *http.Request) (int, error) {
+	v := r.FormValue("replies")
+	if v == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errBadReplies
+	}
+	if n > maxLimit {
+		n = maxLimit
+	}
+	return n, nil
+}
+
+// parentOf returns the id of the comment a comment replies to, zero for
+// top-level comments.
+func parentOf(conn redis.Conn, host, path string, id int64) (int64, error) {
+	parentID, err := redis.String(conn.Do("HGET", fmt.Sprintf(keyComment, host, path, id), "parent_id"))
+	if err == redis.ErrNil || parentID == "" {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(parentID, 10, 64)
+}
+
+// addReply adds an approved comment to the replies of its parent.
+func addReply(conn redis.Conn, host, path string, id, score int64) error {
+	parent, err := parentOf(conn, host, path, id)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("ZADD", fmt.Sprintf(keyReplies, host, path, parent), score, id)
+	return err
+}
+
+// removeReply removes a comment from the replies of its parent, for when it's
+// no longer approved.
+func removeReply(conn redis.Conn, host, path string, id int64) error {
+	parent, err := parentOf(conn, host, path, id)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("ZREM", fmt.Sprintf(keyReplies, host, path, parent), id)
+	return err
+}
+
+// indexReplies adds every approved comment to the replies of its parent, and
+// returns how many it added.
+func indexReplies(conn redis.Conn) (int, error) {
+	prefix := "{" + keyPrefix + "://"
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*}:approved", "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return n, err
+		}
+		for _, key := range keys {
+			host, path := splitPage(strings.TrimSuffix(strings.TrimPrefix(key, prefix), "}:approved"))
+			pairs, err := redis.Int64s(conn.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+			if err != nil {
+				return n, err
+			}
+			for i := 0; i < len(pairs); i += 2 {
+				if err = addReply(conn, host, path, pairs[i], pairs[i+1]); err != nil {
+					return n, err
+				}
+				n++
+			}
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// getReplies returns at most limit approved direct replies to parent, zero
+// for top-level comments, skipping the first offset, and whether there are
+// more. Every comment comes with its first replies replies.
+func getReplies(ctx context.Context, conn redis.Conn, host, path string, parent int64, offset, limit int, desc bool, replies int) ([]threadComment, bool, error) {
+	conn = withContext(ctx, conn)
+	limit, err := checkPage(offset, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	cmd, from, to := "ZRANGEBYSCORE", "-inf", "+inf"
+	if desc {
+		cmd, from, to = "ZREVRANGEBYSCORE", "+inf", "-inf"
+	}
+	// Fetch one extra id to find out if there's more after this page
+	pairs, err := redis.Strings(conn.Do(cmd,
+		fmt.Sprintf(keyReplies, host, path, parent),
+		from, to, "WITHSCORES", "LIMIT", offset, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := len(pairs) > 2*limit
+	if hasMore {
+		pairs = pairs[:2*limit]
+	}
+	comments, err := loadThread(conn, host, path, pairs, replies)
+	return comments, hasMore, err
+}
+
+// loadThread loads comments like loadComments does, with their reply count,
+// and with replies > 0, the oldest replies replies to each of them.
+func loadThread(conn redis.Conn, host, path string, pairs []string, replies int) ([]threadComment, error) {
+	full, err := loadComments(conn, host, path, pairs)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range full {
+		id, _ := strconv.ParseInt(c.ID, 10, 64)
+		conn.Send("ZCARD", fmt.Sprintf(keyReplies, host, path, id))
+		if replies > 0 {
+			conn.Send("ZRANGE", fmt.Sprintf(keyReplies, host, path, id), 0, replies-1, "WITHSCORES")
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+	comments := make([]threadComment, len(full))
+	replyPairs := make([][]string, len(full))
+	for i, c := range full {
+		comments[i].comment = c.comment
+		if comments[i].ReplyCount, err = redis.Int(conn.Receive()); err != nil {
+			return nil, err
+		}
+		if replies > 0 {
+			if replyPairs[i], err = redis.Strings(conn.Receive()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, pairs := range replyPairs {
+		if len(pairs) == 0 {
+			continue
+		}
+		// Only one level, deeper replies are fetched when they're wanted
+		if comments[i].Replies, err = loadThread(conn, host, path, pairs, 0); err != nil {
+			return nil, err
+		}
+	}
+	return comments, nil
+}
+
+// repliesHandler returns a page of the approved direct replies to a comment,
+// for loading the rest of a thread.
+func (s *Server) repliesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := commentURL(r)
+	if err != nil {
+		http.Error(w, "bad URL", http.StatusBadRequest)
+		return
+	}
+	parentID := r.FormValue("parent_id")
+	parent, err := strconv.ParseInt(parentID, 10, 64)
+	if err != nil || parent <= 0 {
+		http.Error(w, errBadParent.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	desc, err := orderParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), redisTimeout)
+	defer cancel()
+	conn := s.pool.Get()
+	defer conn.Close()
+	cors, err := corsOrigin(conn, r)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	approved, err := isApproved(withContext(ctx, conn), u.Host, u.Path, parent)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !approved {
+		http.Error(w, errNoComment.Error(), http.StatusNotFound)
+		return
+	}
+	// Replies to it can't be nested deeper than maxDepth either
+	err = checkParent(withContext(ctx, conn), u.Host, u.Path, parentID)
+	if err == errTooDeep {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil && err != errBadParent {
+		backendError(w, err)
+		return
+	}
+	comments, hasMore, err := getReplies(ctx, conn, u.Host, u.Path, parent, offset, limit, desc, 0)
+	if err == errBadOffset || err == errBadLimit {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	body, err := json.Marshal(struct {
+		Comments []threadComment `json:"comments"`
+		HasMore  bool            `json:"has_more"`
+	}{comments, hasMore})
+	if err != nil {
+		slog.Error("Encoding replies failed", "host", u.Host, "path", u.Path, "parent_id", parent, "err", err)
+		http.Error(w, "unable to encode comments", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setCORS(w, cors)
+	if notModified(w, r, fmt.Sprintf("%d:%d:%d:%t", parent, offset, limit, desc), body) {
+		return
+	}
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// trashRetention is how long deleted comments can be restored, before
+// they're purged for good. Zero keeps them forever.
+var trashRetention = envDuration("TRASH_RETENTION", 30*24*time.Hour)
+
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := cleanModerationRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, req.host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	err = trashComment(conn, req.host, req.path, req.id, s.now())
+	if err == errNoComment {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	slog.Info("Deleted comment", "host", req.host, "path", req.path, "id", req.id)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(moderationResult{
+		ID:       req.id,
+		Approved: false,
+		Changed:  true,
+	})
+}
+
+func (s *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := cleanModerationRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ok, err := authorizedFor(conn, r, req.host)
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	approved, err := restoreComment(conn, req.host, req.path, req.id)
+	if err == errNoComment {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		backendError(w, err)
+		return
+	}
+	slog.Info("Restored comment", "host", req.host, "path", req.path, "id", req.id, "approved", approved)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.Encode(moderationResult{
+		ID:       req.id,
+		Approved: approved,
+		Changed:  true,
+	})
+}
+
+// trashComment moves a comment from the :all and :approved zsets to the
+// :trash zset, scored by now. The comment hash stays, with the old score and
+// approval, so restoreComment can put it back.
+func trashComment(conn redis.Conn, host, path string, id int64, now time.Time) error {
+	score, err := redis.Int64(conn.Do("ZSCORE", fmt.Sprintf(keyAll, host, path), id))
+	if err == redis.ErrNil {
+		return errNoComment
+	}
+	if err != nil {
+		return err
+	}
+	approved, err := isApproved(conn, host, path, id)
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("HMSET", fmt.Sprintf(keyComment, host, path, id),
+		"deleted_at", now.UTC().Format(timeFormat),
+		"trashed_score", score,
+		"trashed_approved", approved)
+	conn.Send("ZREM", fmt.Sprintf(keyApproved, host, path), id)
+	conn.Send("ZREM", fmt.Sprintf(keyAll, host, path), id)
+	conn.Send("ZADD", fmt.Sprintf(keyTrash, host, path), now.UnixMilli(), id)
+	if _, err = conn.Do("EXEC"); err != nil || !approved {
+		return err
+	}
+	if err = removeRecent(conn, host, path, id); err != nil {
+		return err
+	}
+	return removeReply(conn, host, path, id)
+}
+
+// restoreComment puts a comment from the :trash zset back where it was, and
+// reports whether it's approved again.
+func restoreComment(conn redis.Conn, host, path string, id int64) (bool, error) {
+	_, err := redis.Int64(conn.Do("ZSCORE", fmt.Sprintf(keyTrash, host, path), id))
+	if err == redis.ErrNil {
+		return false, errNoComment
+	}
+	if err != nil {
+		return false, err
+	}
+	key := fmt.Sprintf(keyComment, host, path, id)
+	values, err := redis.Strings(conn.Do("HMGET", key, "trashed_score", "trashed_approved"))
+	if err != nil {
+		return false, err
+	}
+	score, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		// Purged halfway, or never trashed properly
+		return false, errNoComment
+	}
+	approved := values[1] == "1"
+	conn.Send("MULTI")
+	conn.Send("ZADD", fmt.Sprintf(keyAll, host, path), "NX", score, id)
+	if approved {
+		conn.Send("ZADD", fmt.Sprintf(keyApproved, host, path), "NX", score, id)
+	}
+	conn.Send("ZREM", fmt.Sprintf(keyTrash, host, path), id)
+	conn.Send("HDEL", key, "deleted_at", "trashed_score", "trashed_approved")
+	if _, err = conn.Do("EXEC"); err != nil {
+		return false, err
+	}
+	if approved {
+		publishApproved(conn, host, path, id)
+		if err = addRecent(conn, host, path, id, score); err != nil {
+			return true, err
+		}
+		if err = addReply(conn, host, path, id, score); err != nil {
+			return true, err
+		}
+	}
+	return approved, nil
+}
+
+// purgeTrash deletes the comments that have been in the trash for longer
+// than trashRetention, and returns how many it deleted.
+func purgeTrash(conn redis.Conn, now time.Time) (int, error) {
+	if trashRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-trashRetention).UnixMilli()
+	prefix := "{" + keyPrefix + "://"
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*}:trash", "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return n, err
+		}
+		for _, key := range keys {
+			host, path := splitPage(strings.TrimSuffix(strings.TrimPrefix(key, prefix), "}:trash"))
+			ids, err := redis.Int64s(conn.Do("ZRANGEBYSCORE", key, "-inf", cutoff))
+			if err != nil {
+				return n, err
+			}
+			for _, id := range ids {
+				if _, err = deleteComment(conn, host, path, id); err != nil {
+					return n, err
+				}
+				n++
+			}
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// purgeTrashLoop runs purgeTrash every hour, for as long as the process runs.
+func (s *Server) purgeTrashLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		conn := s.pool.Get()
+		n, err := purgeTrash(conn, s.now())
+		conn.Close()
+		if err != nil {
+			redisErrors.Inc()
+			slog.Error("Purging the trash failed", "purged", n, "err", err)
+		} else if n > 0 {
+			slog.Info("Purged the trash", "purged", n)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTrashRecent(t *testing.T) {
+	s, m := newTestServer(t)
+	conn := s.pool.Get()
+	defer conn.Close()
+	id := saveTestComment(t, conn, "Alice", "Hello", true)
+	key := fmt.Sprintf(keyRecent, "example.com")
+	member := fmt.Sprintf("%d /post", id)
+
+	if err := trashComment(conn, "example.com", "/post", id, testNow); err != nil {
+		t.Fatalf("trashComment: %v", err)
+	}
+	if members, _ := m.ZMembers(key); len(members) != 0 {
+		t.Errorf("recent comments after trashing = %v, want none", members)
+	}
+	approved, err := restoreComment(conn, "example.com", "/post", id)
+	if err != nil || !approved {
+		t.Fatalf("restoreComment = %t, %v, want approved", approved, err)
+	}
+	if members, _ := m.ZMembers(key); len(members) != 1 || members[0] != member {
+		t.Errorf("recent comments after restoring = %v, want %q", members, member)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// wxrItem is a post in a WordPress export (WXR) file, with its comments.
+// The wp: namespace differs between WXR versions, so it's left out.
+type wxrItem struct {
+	Link     string       `xml:"link"`
+	Comments []wxrComment `xml:"comment"`
+}
+
+type wxrComment struct {
+	ID          int64  `xml:"comment_id"`
+	Author      string `xml:"comment_author"`
+	AuthorEmail string `xml:"comment_author_email"`
+	AuthorURL   string `xml:"comment_author_url"`
+	AuthorIP    string `xml:"comment_author_IP"`
+	DateGMT     string `xml:"comment_date_gmt"`
+	Content     string `xml:"comment_content"`
+	// Approved is 1 for approved comments, 0 for pending ones, and spam or
+	// trash for the others
+	Approved string `xml:"comment_approved"`
+	// Type is empty or comment for comments, or pingback or trackback
+	Type   string `xml:"comment_type"`
+	Parent int64  `xml:"comment_parent"`
+}
+
+// wxrTimeFormat is the format of comment_date_gmt
+const wxrTimeFormat = "2006-01-02 15:04:05"
+
+// importWXR saves the comments in a WordPress export read from r, on the
+// page of the link of their post, and approves the ones that were approved
+// in WordPress. Spam, trash, pingbacks and trackbacks are skipped. It returns
+// the number of comments imported.
+func importWXR(conn redis.Conn, r io.Reader) (int, error) {
+	n := 0
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "item" {
+			continue
+		}
+		var item wxrItem
+		if err = d.DecodeElement(&item, &start); err != nil {
+			return n, err
+		}
+		imported, err := importWXRItem(conn, &item)
+		n += imported
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func importWXRItem(conn redis.Conn, item *wxrItem) (int, error) {
+	if len(item.Comments) == 0 {
+		return 0, nil
+	}
+	u, err := url.Parse(item.Link)
+	if err != nil || u.Host == "" {
+		return 0, fmt.Errorf("bad link %q", item.Link)
+	}
+	u = normalizeURL(u)
+	// Parents first, so replies can point at their new id
+	sort.Slice(item.Comments, func(i, j int) bool {
+		return item.Comments[i].ID < item.Comments[j].ID
+	})
+	ids := make(map[int64]int64)
+	n := 0
+	for _, c := range item.Comments {
+		if c.Approved != "0" && c.Approved != "1" {
+			continue
+		}
+		if c.Type != "" && c.Type != "comment" {
+			continue
+		}
+		date, err := time.Parse(wxrTimeFormat, c.DateGMT)
+		if err != nil {
+			return n, fmt.Errorf("bad date of comment %d on %s: %v", c.ID, item.Link, err)
+		}
+		req := &commentSubmitRequest{
+			Permalink:   u.String(),
+			host:        u.Host,
+			path:        u.Path,
+			realIP:      c.AuthorIP,
+			UserIP:      anonymizeIP(c.AuthorIP),
+			Author:      c.Author,
+			AuthorEmail: c.AuthorEmail,
+			AuthorURL:   c.AuthorURL,
+			Content:     c.Content,
+		}
+		if parent, ok := ids[c.Parent]; ok {
+			req.ParentID = strconv.FormatInt(parent, 10)
+		}
+		id, err := saveComment(context.Background(), conn, req, date)
+		if err != nil {
+			return n, err
+		}
+		ids[c.ID] = id
+		if c.Approved == "1" {
+			if _, err = approveComment(conn, u.Host, u.Path, id); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	slog.Info("Imported comments", "host", u.Host, "path", u.Path, "imported", n)
+	return n, nil
+}